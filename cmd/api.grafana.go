@@ -0,0 +1,394 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type grafanaProvider struct {
+	api_key string
+	team    string
+	url     string
+
+	emails map[string]string
+}
+
+type grafanaSchedule struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	OnCallNow []string `json:"on_call_now"`
+	Shifts    []string `json:"shifts"`
+	TeamID    string   `json:"team_id"`
+}
+
+func newGrafanaProvider(conf map[string]string) (*grafanaProvider, error) {
+	p := &grafanaProvider{
+		api_key: conf["api_key"],
+		team:    conf["team"],
+		url:     conf["url"],
+		emails:  make(map[string]string),
+	}
+
+	if p.api_key == "" {
+		if p.api_key = viper.GetString("grafana.api.key"); p.api_key == "" {
+			return nil, fmt.Errorf("grafana oncall API key is empty")
+		}
+	}
+
+	if p.url == "" {
+		if p.url = viper.GetString("grafana.api.url"); p.url == "" {
+			return nil, fmt.Errorf("grafana oncall API url is empty")
+		}
+	}
+
+	p.url = strings.TrimSuffix(p.url, "/")
+
+	return p, nil
+}
+
+func (p *grafanaProvider) request(ctx context.Context, method, path string, in, out interface{}) error {
+	header := http.Header{}
+	header.Set("Authorization", p.api_key)
+
+	if !strings.HasPrefix(path, "http") {
+		path = p.url + path
+	}
+
+	return apiRequest(ctx, method, path, header, in, out)
+}
+
+func (p *grafanaProvider) schedule(ctx context.Context, name string) (*grafanaSchedule, error) {
+	var res struct {
+		Results []grafanaSchedule `json:"results"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/api/v1/schedules/?name="+url.QueryEscape(name), nil, &res); err != nil {
+		return nil, err
+	}
+
+	for _, item := range res.Results {
+		if item.Name == name {
+			return &item, nil
+		}
+	}
+
+	return nil, fmt.Errorf("can't find grafana oncall schedule %#v", name)
+}
+
+func (p *grafanaProvider) userID(ctx context.Context, email string) (string, error) {
+	for id, item := range p.emails {
+		if strings.EqualFold(item, email) {
+			return id, nil
+		}
+	}
+
+	for next := "/api/v1/users/"; next != ""; {
+		var res struct {
+			Next    string `json:"next"`
+			Results []struct {
+				ID    string `json:"id"`
+				Email string `json:"email"`
+			} `json:"results"`
+		}
+
+		if err := p.request(ctx, http.MethodGet, next, nil, &res); err != nil {
+			return "", err
+		}
+
+		for _, user := range res.Results {
+			p.emails[user.ID] = user.Email
+		}
+
+		for _, user := range res.Results {
+			if strings.EqualFold(user.Email, email) {
+				return user.ID, nil
+			}
+		}
+
+		next = res.Next
+	}
+
+	return "", fmt.Errorf("can't find grafana oncall user %#v", email)
+}
+
+func (p *grafanaProvider) userEmail(ctx context.Context, id string) (string, error) {
+	if email, ok := p.emails[id]; ok {
+		return email, nil
+	}
+
+	var res struct {
+		Email string `json:"email"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, fmt.Sprintf("/api/v1/users/%s/", id), nil, &res); err != nil {
+		return "", err
+	}
+
+	p.emails[id] = res.Email
+
+	return res.Email, nil
+}
+
+// GetOnCalls returns everyone on call as the primary, the schedules have no
+// escalation levels
+func (p *grafanaProvider) GetOnCalls(ctx context.Context, name string) ([]OnCall, error) {
+	schedule, err := p.schedule(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []OnCall{}
+	for _, id := range schedule.OnCallNow {
+		email, err := p.userEmail(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, OnCall{User: email})
+	}
+
+	return users, nil
+}
+
+// CreateOverride creates an override shift and attaches it to the schedule,
+// grafana oncall has no dedicated override endpoint in the public API
+func (p *grafanaProvider) CreateOverride(ctx context.Context, name, user string, start, end time.Time) error {
+	schedule, err := p.schedule(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	uid, err := p.userID(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	var shift struct {
+		ID string `json:"id"`
+	}
+
+	if err := p.request(ctx, http.MethodPost, "/api/v1/on_call_shifts/", map[string]interface{}{
+		"name":           fmt.Sprintf("%s override %s", pkg, start.UTC().Format(time.RFC3339)),
+		"type":           "override",
+		"team_id":        schedule.TeamID,
+		"time_zone":      "UTC",
+		"start":          start.UTC().Format("2006-01-02T15:04:05"),
+		"rotation_start": start.UTC().Format("2006-01-02T15:04:05"),
+		"duration":       int(end.Sub(start).Seconds()),
+		"users":          []string{uid},
+	}, &shift); err != nil {
+		return err
+	}
+
+	return p.request(ctx, http.MethodPut, fmt.Sprintf("/api/v1/schedules/%s/", schedule.ID), map[string]interface{}{
+		"shifts": append(schedule.Shifts, shift.ID),
+	}, nil)
+}
+
+func (p *grafanaProvider) GetTeamMembers(ctx context.Context, name string) ([]string, error) {
+	return nil, fmt.Errorf("grafana oncall: the team members are %w", errNotSupported)
+}
+
+func (p *grafanaProvider) GetOverrides(ctx context.Context, name string) ([]Shift, error) {
+	return nil, fmt.Errorf("grafana oncall: listing the overrides is %w", errNotSupported)
+}
+
+func (p *grafanaProvider) GetOverrideHistory(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	return nil, fmt.Errorf("grafana oncall: listing the overrides is %w", errNotSupported)
+}
+
+func (p *grafanaProvider) DeleteOverride(ctx context.Context, name, id string) error {
+	return fmt.Errorf("grafana oncall: deleting the overrides is %w", errNotSupported)
+}
+
+func (p *grafanaProvider) GetShifts(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	schedule, err := p.schedule(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("start_date", start.UTC().Format("2006-01-02"))
+	query.Set("end_date", end.UTC().Format("2006-01-02"))
+
+	shifts := []Shift{}
+
+	for next := fmt.Sprintf("/api/v1/schedules/%s/final_shifts?%s", schedule.ID, query.Encode()); next != ""; {
+		var res struct {
+			Next    string `json:"next"`
+			Results []struct {
+				UserEmail  string    `json:"user_email"`
+				ShiftStart time.Time `json:"shift_start"`
+				ShiftEnd   time.Time `json:"shift_end"`
+			} `json:"results"`
+		}
+
+		if err := p.request(ctx, http.MethodGet, next, nil, &res); err != nil {
+			return nil, err
+		}
+
+		for _, item := range res.Results {
+			if item.ShiftEnd.After(start) && item.ShiftStart.Before(end) {
+				shifts = append(shifts, Shift{User: item.UserEmail, Start: item.ShiftStart, End: item.ShiftEnd})
+			}
+		}
+
+		next = res.Next
+	}
+
+	return shifts, nil
+}
+
+// CreateAlert pages the configured team or, without a team, every user who is
+// on call in the schedule; P1 and P2 alerts are sent as important
+func (p *grafanaProvider) CreateAlert(ctx context.Context, req AlertRequest) (string, error) {
+	page := map[string]interface{}{
+		"title":     req.Message,
+		"message":   strings.TrimSpace(req.Description + "\n\n" + req.detailsText()),
+		"important": req.Priority == "P1" || req.Priority == "P2",
+	}
+
+	if p.team != "" {
+		page["team"] = p.team
+	} else {
+		schedule, err := p.schedule(ctx, req.Schedule)
+		if err != nil {
+			return "", err
+		}
+
+		users := []map[string]interface{}{}
+		for _, id := range schedule.OnCallNow {
+			users = append(users, map[string]interface{}{"id": id, "important": page["important"]})
+		}
+
+		if len(users) < 1 {
+			return "", fmt.Errorf("there are no on-duty on the schedule %#v", req.Schedule)
+		}
+
+		page["users"] = users
+	}
+
+	var res struct {
+		ID string `json:"id"`
+	}
+
+	if err := p.request(ctx, http.MethodPost, "/api/v1/escalation/", page, &res); err != nil {
+		return "", err
+	}
+
+	return res.ID, nil
+}
+
+// CloseAlert resolves the alert group on behalf of the API key owner, the
+// chat user is only known from the note
+func (p *grafanaProvider) CloseAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	if err := p.request(ctx, http.MethodPost, fmt.Sprintf("/api/v1/alert_groups/%s/resolve/", alertID), nil, nil); err != nil {
+		return err
+	}
+
+	return p.updateNote(ctx, alertID, update)
+}
+
+func (p *grafanaProvider) AlertClosed(ctx context.Context, alertID string) (bool, error) {
+	var res struct {
+		State string `json:"state"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, fmt.Sprintf("/api/v1/alert_groups/%s/", alertID), nil, &res); err != nil {
+		return false, err
+	}
+
+	return res.State == "resolved", nil
+}
+
+func (p *grafanaProvider) AckAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	if err := p.request(ctx, http.MethodPost, fmt.Sprintf("/api/v1/alert_groups/%s/acknowledge/", alertID), nil, nil); err != nil {
+		return err
+	}
+
+	return p.updateNote(ctx, alertID, update)
+}
+
+func (p *grafanaProvider) updateNote(ctx context.Context, alertID string, update AlertUpdate) error {
+	if update.Note == "" {
+		return nil
+	}
+
+	return p.AddNote(ctx, alertID, update.Note)
+}
+
+// AddNote adds a resolution note, grafana oncall has no other notes
+func (p *grafanaProvider) AddNote(ctx context.Context, alertID, note string) error {
+	return p.request(ctx, http.MethodPost, "/api/v1/resolution_notes/", map[string]string{
+		"alert_group_id": alertID,
+		"text":           note,
+	}, nil)
+}
+
+func (p *grafanaProvider) SetAlertPriority(ctx context.Context, alertID, priority string) error {
+	return fmt.Errorf("grafana oncall: changing the alert priority is %w", errNotSupported)
+}
+
+// AddResponders pages more users or a team (by ID) in the existing alert group
+func (p *grafanaProvider) AddResponders(ctx context.Context, alertID string, responders []Responder) error {
+	page := map[string]interface{}{"alert_group_id": alertID}
+	users := []map[string]interface{}{}
+
+	for _, responder := range responders {
+		switch responder.Type {
+		case "user":
+			id, err := p.userID(ctx, responder.Name)
+			if err != nil {
+				return err
+			}
+
+			users = append(users, map[string]interface{}{"id": id, "important": false})
+		case "team":
+			page["team"] = responder.Name
+		default:
+			return fmt.Errorf("unknown responder type %#v", responder.Type)
+		}
+	}
+
+	if len(users) > 0 {
+		page["users"] = users
+	}
+
+	return p.request(ctx, http.MethodPost, "/api/v1/escalation/", page, nil)
+}
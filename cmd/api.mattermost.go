@@ -0,0 +1,676 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
+)
+
+var mattermostColors = map[string]string{
+	"danger":  "#a30200",
+	"good":    "#2eb886",
+	"warning": "#daa038",
+}
+
+type mattermostBackend struct {
+	api_key       string
+	command_token string
+	group         string
+	public_url    string
+	secret        string
+	url           string
+
+	bot   string
+	mu    sync.Mutex
+	teams map[string]string
+	users map[string]mattermostUser
+
+	events chan Event
+	log    *log.Entry
+}
+
+type mattermostUser struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Locale    string `json:"locale"`
+	Timezone  struct {
+		AutomaticTimezone    string `json:"automaticTimezone"`
+		ManualTimezone       string `json:"manualTimezone"`
+		UseAutomaticTimezone string `json:"useAutomaticTimezone"`
+	} `json:"timezone"`
+	Username string `json:"username"`
+}
+
+type mattermostPost struct {
+	ID        string                 `json:"id,omitempty"`
+	ChannelID string                 `json:"channel_id,omitempty"`
+	Message   string                 `json:"message"`
+	Props     map[string]interface{} `json:"props,omitempty"`
+	RootID    string                 `json:"root_id,omitempty"`
+	UserID    string                 `json:"user_id,omitempty"`
+}
+
+func newMattermostBackend(group string, conf map[string]string, logger *log.Entry) (*mattermostBackend, error) {
+	c := &mattermostBackend{
+		api_key:       conf["api_key"],
+		command_token: conf["command_token"],
+		group:         group,
+		public_url:    strings.TrimSuffix(viper.GetString("_daemon.public_url"), "/"),
+		secret:        conf["secret"],
+		url:           conf["url"],
+		teams:         make(map[string]string),
+		users:         make(map[string]mattermostUser),
+		events:        make(chan Event, 100),
+		log:           logger,
+	}
+
+	if c.api_key == "" {
+		if c.api_key = viper.GetString("mattermost.api.key"); c.api_key == "" {
+			return nil, fmt.Errorf("mattermost API key is empty")
+		}
+	}
+
+	if c.url == "" {
+		if c.url = viper.GetString("mattermost.api.url"); c.url == "" {
+			return nil, fmt.Errorf("mattermost API url is empty")
+		}
+	}
+
+	c.url = strings.TrimSuffix(c.url, "/")
+
+	// the secret protects the button callbacks, without it in the config the
+	// buttons of the messages posted before a restart stop working
+	if c.secret == "" {
+		data := make([]byte, 16)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+
+		c.secret = hex.EncodeToString(data)
+	}
+
+	return c, nil
+}
+
+func (c *mattermostBackend) request(method, path string, in, out interface{}) error {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", c.api_key))
+
+	return apiRequest(context.Background(), method, c.url+"/api/v4"+path, header, in, out)
+}
+
+func (c *mattermostBackend) Run(handler func(Event)) error {
+	if c.public_url == "" {
+		return fmt.Errorf("_daemon.public_url is required for the mattermost buttons")
+	}
+
+	var me mattermostUser
+
+	if err := c.request(http.MethodGet, "/users/me", nil, &me); err != nil {
+		return err
+	}
+
+	c.bot = me.ID
+
+	daemonHandle(fmt.Sprintf("/mattermost/%s/action", c.group), c.handleAction)
+	daemonHandle(fmt.Sprintf("/mattermost/%s/command", c.group), c.handleCommand)
+
+	go c.watchEvents()
+
+	go func() {
+		for e := range c.events {
+			handler(e)
+		}
+	}()
+
+	return nil
+}
+
+func (c *mattermostBackend) watchEvents() {
+	for {
+		if err := c.readEvents(); err != nil {
+			c.log.Errorf("mattermost websocket - %s", err.Error())
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (c *mattermostBackend) readEvents() error {
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(c.url, "http")+"/api/v4/websocket",
+		http.Header{"Authorization": {fmt.Sprintf("Bearer %s", c.api_key)}},
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	c.log.Info("connected to the mattermost websocket")
+
+	for {
+		var msg struct {
+			Event string `json:"event"`
+			Data  struct {
+				Mentions string `json:"mentions"`
+				Post     string `json:"post"`
+				Reaction string `json:"reaction"`
+			} `json:"data"`
+			Broadcast struct {
+				ChannelID string `json:"channel_id"`
+			} `json:"broadcast"`
+		}
+
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+
+		if msg.Event == "reaction_added" {
+			var reaction struct {
+				EmojiName string `json:"emoji_name"`
+				PostID    string `json:"post_id"`
+				UserID    string `json:"user_id"`
+			}
+
+			json.Unmarshal([]byte(msg.Data.Reaction), &reaction)
+
+			if reaction.UserID == c.bot {
+				continue
+			}
+
+			c.events <- Event{
+				Type:      "reaction",
+				ChannelID: msg.Broadcast.ChannelID,
+				Data:      reaction.EmojiName,
+				TimeStamp: reaction.PostID,
+				UserID:    reaction.UserID,
+			}
+
+			continue
+		}
+
+		if msg.Event != "posted" {
+			c.log.Debugf("skipped: %v", msg.Event)
+			continue
+		}
+
+		var (
+			mentions []string
+			post     mattermostPost
+		)
+
+		json.Unmarshal([]byte(msg.Data.Mentions), &mentions)
+		json.Unmarshal([]byte(msg.Data.Post), &post)
+
+		if post.UserID == c.bot {
+			continue
+		}
+
+		e := Event{
+			Type:            "mention",
+			ChannelID:       post.ChannelID,
+			Data:            post.Message,
+			ThreadTimeStamp: post.RootID,
+			TimeStamp:       post.ID,
+			UserID:          post.UserID,
+		}
+
+		if !slices.Contains(mentions, c.bot) {
+			// the replies in threads become the alert notes
+			if post.RootID == "" {
+				continue
+			}
+
+			e.Type = "reply"
+			e.Bot = fmt.Sprint(post.Props["from_bot"]) == "true"
+		}
+
+		c.events <- e
+	}
+}
+
+func (c *mattermostBackend) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if c.command_token == "" || subtle.ConstantTimeCompare([]byte(r.Form.Get("token")), []byte(c.command_token)) != 1 {
+		c.log.Warn("slash command with a wrong token")
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	c.events <- Event{
+		Type:      "command",
+		Action:    "SlashCommand",
+		ChannelID: r.Form.Get("channel_id"),
+		Data:      r.Form.Get("text"),
+		UserID:    r.Form.Get("user_id"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func (c *mattermostBackend) handleAction(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChannelID string            `json:"channel_id"`
+		Context   map[string]string `json:"context"`
+		PostID    string            `json:"post_id"`
+		UserID    string            `json:"user_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Context["token"]), []byte(c.secret)) != 1 {
+		c.log.Warn("button callback with a wrong token")
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Context["action"] {
+	case
+		"alert_acknowledge",
+		"alert_close",
+		"alert_increase_priority",
+		"swap_accept",
+		"swap_decline",
+		"take_cancel",
+		"take_confirm":
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	c.events <- Event{
+		Type:          "interactive",
+		Action:        req.Context["action"],
+		AlertID:       req.Context["alert_id"],
+		AlertPriority: req.Context["priority"],
+		ChannelID:     req.ChannelID,
+		TimeStamp:     req.PostID,
+		UserID:        req.UserID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func (c *mattermostBackend) attachment(msg AlertMessage) map[string]interface{} {
+	actions := []map[string]interface{}{}
+
+	for _, item := range msg.Actions {
+		action := map[string]interface{}{
+			"id":   strings.ReplaceAll(item, "_", ""),
+			"type": "button",
+			"integration": map[string]interface{}{
+				"url": fmt.Sprintf("%s/mattermost/%s/action", c.public_url, c.group),
+				"context": map[string]string{
+					"action":   item,
+					"alert_id": msg.AlertID,
+					"priority": msg.Priority,
+					"token":    c.secret,
+				},
+			},
+		}
+
+		switch item {
+		case "alert_increase_priority":
+			action["name"] = "Increase priority"
+			action["style"] = "danger"
+		case "alert_acknowledge":
+			action["name"] = "Ack"
+		case "alert_close":
+			action["name"] = "Close"
+			action["style"] = "primary"
+		case "swap_accept":
+			action["name"] = "Accept"
+			action["style"] = "primary"
+		case "swap_decline":
+			action["name"] = "Decline"
+		case "take_confirm":
+			action["name"] = "Confirm"
+			action["style"] = "primary"
+		case "take_cancel":
+			action["name"] = "Cancel"
+		default:
+			continue
+		}
+
+		actions = append(actions, action)
+	}
+
+	fields := []map[string]interface{}{}
+
+	for _, field := range msg.Fields {
+		fields = append(fields, map[string]interface{}{
+			"short": true,
+			"title": field.Title,
+			"value": field.Value,
+		})
+	}
+
+	color := msg.Color
+	if hex, ok := mattermostColors[color]; ok {
+		color = hex
+	}
+
+	return map[string]interface{}{
+		"actions":  actions,
+		"color":    color,
+		"fallback": msg.Text,
+		"fields":   fields,
+		"text":     msg.Text,
+	}
+}
+
+func (c *mattermostBackend) OpenAlertForm(trigger string, opts AlertFormOptions) error {
+	return fmt.Errorf("mattermost: the alert form is %w", errNotSupported)
+}
+
+func (c *mattermostBackend) GetChannelName(channel string) (string, error) {
+	var ch struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.request(http.MethodGet, "/channels/"+channel, nil, &ch); err != nil {
+		return "", err
+	}
+
+	return ch.Name, nil
+}
+
+func (c *mattermostBackend) GetPermalink(channel, ts string) (string, error) {
+	c.mu.Lock()
+	team, ok := c.teams[channel]
+	c.mu.Unlock()
+
+	if !ok {
+		var ch struct {
+			TeamID string `json:"team_id"`
+		}
+
+		if err := c.request(http.MethodGet, "/channels/"+channel, nil, &ch); err != nil {
+			return "", err
+		}
+
+		var t struct {
+			Name string `json:"name"`
+		}
+
+		if err := c.request(http.MethodGet, "/teams/"+ch.TeamID, nil, &t); err != nil {
+			return "", err
+		}
+
+		team = t.Name
+
+		c.mu.Lock()
+		c.teams[channel] = team
+		c.mu.Unlock()
+	}
+
+	return fmt.Sprintf("%s/%s/pl/%s", c.url, team, ts), nil
+}
+
+func (c *mattermostBackend) PostAlert(channel, thread string, msg AlertMessage) (string, error) {
+	var post mattermostPost
+
+	if err := c.request(http.MethodPost, "/posts", mattermostPost{
+		ChannelID: channel,
+		Props:     map[string]interface{}{"attachments": []interface{}{c.attachment(msg)}},
+		RootID:    thread,
+	}, &post); err != nil {
+		return "", err
+	}
+
+	return post.ID, nil
+}
+
+func (c *mattermostBackend) UpdateAlert(channel, ts string, msg AlertMessage) error {
+	return c.request(http.MethodPut, fmt.Sprintf("/posts/%s/patch", ts), map[string]interface{}{
+		"props": map[string]interface{}{"attachments": []interface{}{c.attachment(msg)}},
+	}, nil)
+}
+
+func (c *mattermostBackend) PostMessage(channel, text string) error {
+	return c.request(http.MethodPost, "/posts", mattermostPost{
+		ChannelID: channel,
+		Message:   text,
+	}, nil)
+}
+
+func (c *mattermostBackend) PostEphemeral(channel, user, text string) error {
+	return c.request(http.MethodPost, "/posts/ephemeral", map[string]interface{}{
+		"user_id": user,
+		"post": mattermostPost{
+			ChannelID: channel,
+			Message:   text,
+		},
+	}, nil)
+}
+
+func (c *mattermostBackend) user(id string) (mattermostUser, error) {
+	c.mu.Lock()
+	user, ok := c.users[id]
+	c.mu.Unlock()
+
+	if ok {
+		return user, nil
+	}
+
+	if err := c.request(http.MethodGet, "/users/"+id, nil, &user); err != nil {
+		return user, err
+	}
+
+	c.mu.Lock()
+	c.users[id] = user
+	c.mu.Unlock()
+
+	return user, nil
+}
+
+func (c *mattermostBackend) Mention(user string) string {
+	u, err := c.user(user)
+	if err != nil {
+		c.log.Warnf("can't get user info %#v", user)
+
+		return user
+	}
+
+	return fmt.Sprintf("@%s", u.Username)
+}
+
+func (c *mattermostBackend) GetUserGroups() (map[string]string, error) {
+	list := make(map[string]string)
+
+	for page := 0; ; page++ {
+		var groups []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+
+		if err := c.request(http.MethodGet, fmt.Sprintf("/groups?filter_allow_reference=true&per_page=200&page=%d", page), nil, &groups); err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			list[group.Name] = group.ID
+		}
+
+		if len(groups) < 200 {
+			return list, nil
+		}
+	}
+}
+
+func (c *mattermostBackend) GetUserGroupMembers(group string) ([]string, error) {
+	members := []string{}
+
+	for page := 0; ; page++ {
+		var res struct {
+			Members []mattermostUser `json:"members"`
+		}
+
+		if err := c.request(http.MethodGet, fmt.Sprintf("/groups/%s/members?per_page=200&page=%d", group, page), nil, &res); err != nil {
+			return nil, err
+		}
+
+		for _, member := range res.Members {
+			members = append(members, member.ID)
+		}
+
+		if len(res.Members) < 200 {
+			return members, nil
+		}
+	}
+}
+
+// UpdateUserGroupMembers replaces the members of a custom group, mattermost
+// only has endpoints to add and delete members so the difference is applied
+func (c *mattermostBackend) UpdateUserGroupMembers(group string, members []string) error {
+	current, err := c.GetUserGroupMembers(group)
+	if err != nil {
+		return err
+	}
+
+	add, remove := []string{}, []string{}
+
+	for _, uid := range members {
+		if !slices.Contains(current, uid) {
+			add = append(add, uid)
+		}
+	}
+
+	for _, uid := range current {
+		if !slices.Contains(members, uid) {
+			remove = append(remove, uid)
+		}
+	}
+
+	if len(add) > 0 {
+		if err := c.request(http.MethodPost, fmt.Sprintf("/groups/%s/members", group), map[string][]string{"user_ids": add}, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := c.request(http.MethodDelete, fmt.Sprintf("/groups/%s/members", group), map[string][]string{"user_ids": remove}, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *mattermostBackend) GetUserByEmail(email string) (string, error) {
+	var user mattermostUser
+
+	if err := c.request(http.MethodGet, "/users/email/"+url.PathEscape(email), nil, &user); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.users[user.ID] = user
+	c.mu.Unlock()
+
+	return user.ID, nil
+}
+
+func (c *mattermostBackend) GetUserEmail(user string) (string, error) {
+	u, err := c.user(user)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Email, nil
+}
+
+func (c *mattermostBackend) GetUserName(user string) (string, error) {
+	u, err := c.user(user)
+	if err != nil {
+		return "", err
+	}
+
+	if name := strings.TrimSpace(u.FirstName + " " + u.LastName); name != "" {
+		return name, nil
+	}
+
+	return u.Username, nil
+}
+
+func (c *mattermostBackend) GetUserLocale(user string) (string, error) {
+	u, err := c.user(user)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Locale, nil
+}
+
+func (c *mattermostBackend) GetUserTimezone(user string) (string, error) {
+	u, err := c.user(user)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Timezone.UseAutomaticTimezone == "true" {
+		return u.Timezone.AutomaticTimezone, nil
+	}
+
+	return u.Timezone.ManualTimezone, nil
+}
+
+func (c *mattermostBackend) Workspace() string {
+	return strings.TrimPrefix(strings.TrimPrefix(c.url, "https://"), "http://")
+}
@@ -33,122 +33,173 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/opsgenie/opsgenie-go-sdk-v2/alert"
 	"github.com/opsgenie/opsgenie-go-sdk-v2/client"
+	"github.com/opsgenie/opsgenie-go-sdk-v2/og"
 	"github.com/opsgenie/opsgenie-go-sdk-v2/schedule"
+	"github.com/opsgenie/opsgenie-go-sdk-v2/team"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
 )
 
-func (s *Schedules) opsgenieInitSchedule() error {
-	if s.sc != nil {
-		return nil
-	}
+type opsgenieProvider struct {
+	api_key string
 
-	api_key := s.list[0].og_api_key
+	ac *alert.Client
+	sc *schedule.Client
+	tc *team.Client
+}
+
+func newOpsgenieProvider(conf map[string]string) (*opsgenieProvider, error) {
+	api_key := conf["api_key"]
 
 	if api_key == "" {
 		if api_key = viper.GetString("api.key"); api_key == "" {
-			return fmt.Errorf("opsgenie API key is empty")
+			return nil, fmt.Errorf("opsgenie API key is empty")
 		}
 	}
 
+	return &opsgenieProvider{api_key: api_key}, nil
+}
+
+func (p *opsgenieProvider) initSchedule() error {
+	if p.sc != nil {
+		return nil
+	}
+
 	sc, err := schedule.NewClient(&client.Config{
-		ApiKey:     api_key,
-		Logger:     log.StandardLogger(),
-		RetryCount: 5,
+		ApiKey:         p.api_key,
+		Logger:         log.StandardLogger(),
+		RequestTimeout: apiTimeout,
+		RetryCount:     5,
 	})
 	if err != nil {
 		log.Fatal("failed to create a client")
 	}
 
-	s.sc = sc
+	p.sc = sc
 
 	return nil
 }
 
-func (s *Schedules) opsgenieInitAlert() error {
-	if s.ac != nil {
+func (p *opsgenieProvider) initAlert() error {
+	if p.ac != nil {
 		return nil
 	}
 
-	api_key := s.list[0].og_api_key
-
-	if api_key == "" {
-		if api_key = viper.GetString("api.key"); api_key == "" {
-			return fmt.Errorf("opsgenie API key is empty")
-		}
-	}
-
 	ac, err := alert.NewClient(&client.Config{
-		ApiKey:     api_key,
-		Logger:     log.StandardLogger(),
-		RetryCount: 5,
+		ApiKey:         p.api_key,
+		Logger:         log.StandardLogger(),
+		RequestTimeout: apiTimeout,
+		RetryCount:     5,
 	})
 	if err != nil {
 		log.Fatal("failed to create a client")
 	}
 
-	s.ac = ac
+	p.ac = ac
 
 	return nil
 }
 
-func (s *Schedules) opsgenieGetSchedules(sn ...string) error {
-	if err := s.opsgenieInitSchedule(); err != nil {
-		return err
+func (p *opsgenieProvider) initTeam() error {
+	if p.tc != nil {
+		return nil
+	}
+
+	tc, err := team.NewClient(&client.Config{
+		ApiKey:         p.api_key,
+		Logger:         log.StandardLogger(),
+		RequestTimeout: apiTimeout,
+		RetryCount:     5,
+	})
+	if err != nil {
+		log.Fatal("failed to create a client")
 	}
 
-	ctx := context.Background()
+	p.tc = tc
 
-	for idx, item := range s.list {
-		if len(sn) > 0 && sn[0] != item.name {
-			continue
-		}
+	return nil
+}
 
+// GetOnCalls walks the participants of the rotations, the users of an
+// escalation get the level of their escalation time
+func (p *opsgenieProvider) GetOnCalls(ctx context.Context, name string) ([]OnCall, error) {
+	if err := p.initSchedule(); err != nil {
+		return nil, err
+	}
 
-		log.Infof("Schedule loading: %s", item.name)
+	flat := false
+	oc, err := p.sc.GetOnCalls(ctx, &schedule.GetOnCallsRequest{
+		Flat:                   &flat,
+		ScheduleIdentifier:     name,
+		ScheduleIdentifierType: schedule.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		s.list[idx].finalDuty = []string{}
-		for _, team:= range item.duty {
-			if (strings.Contains(team,"@")) {
-				s.list[idx].finalDuty = append(s.list[idx].finalDuty, team)
-				continue;
+	users := []OnCall{}
+	for _, participant := range oc.OnCallParticipants {
+		switch participant.Type {
+		case og.User:
+			users = append(users, OnCall{User: participant.Name})
+		case og.Escalation, og.Team:
+			times := []uint32{}
+			for _, member := range participant.OnCallParticipants {
+				if !slices.Contains(times, member.EscalationTime) {
+					times = append(times, member.EscalationTime)
+				}
 			}
-			flat := false
-			oc, err := s.sc.GetOnCalls(ctx, &schedule.GetOnCallsRequest{
-				Flat:                   &flat,
-				ScheduleIdentifier:     team,
-				ScheduleIdentifierType: schedule.Name,
-			})
 
-			if err != nil {
-				continue
-			}
+			slices.Sort(times)
+
+			for _, member := range participant.OnCallParticipants {
+				if member.Type != og.User {
+					continue
+				}
 
-			for _, participants := range oc.OnCallParticipants {
-				s.list[idx].finalDuty = append(s.list[idx].finalDuty, participants.Name)
+				users = append(users, OnCall{User: member.Name, Level: slices.Index(times, member.EscalationTime)})
 			}
 		}
 	}
 
-	return nil
+	return users, nil
 }
 
-func (s *Schedules) opsgenieOverrideSchedules(user string, duration time.Duration) error {
-	if err := s.opsgenieInitSchedule(); err != nil {
-		return err
+func (p *opsgenieProvider) GetTeamMembers(ctx context.Context, name string) ([]string, error) {
+	if err := p.initTeam(); err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
+	res, err := p.tc.Get(ctx, &team.GetTeamRequest{
+		IdentifierType:  team.Name,
+		IdentifierValue: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, member := range res.Members {
+		users = append(users, member.User.Username)
+	}
+
+	return users, nil
+}
+
+func (p *opsgenieProvider) CreateOverride(ctx context.Context, name, user string, start, end time.Time) error {
+	if err := p.initSchedule(); err != nil {
+		return err
+	}
 
-	if _, err := s.sc.CreateScheduleOverride(ctx, &schedule.CreateScheduleOverrideRequest{
-		EndDate:                time.Now().Add(duration),
-		StartDate:              time.Now(),
-		ScheduleIdentifier:     s.list[0].name,
+	if _, err := p.sc.CreateScheduleOverride(ctx, &schedule.CreateScheduleOverrideRequest{
+		EndDate:                end,
+		StartDate:              start,
+		ScheduleIdentifier:     name,
 		ScheduleIdentifierType: schedule.Name,
 		User: schedule.Responder{
 			Type:     schedule.UserResponderType,
@@ -161,47 +212,167 @@ func (s *Schedules) opsgenieOverrideSchedules(user string, duration time.Duratio
 	return nil
 }
 
-func (s *Schedules) opsgenieAddAlert(message, thread_ts, thread_link string) (string, error) {
-	if err := s.opsgenieInitAlert(); err != nil {
-		return "", err
+func (p *opsgenieProvider) GetOverrides(ctx context.Context, name string) ([]Shift, error) {
+	if err := p.initSchedule(); err != nil {
+		return nil, err
+	}
+
+	res, err := p.sc.ListScheduleOverride(ctx, &schedule.ListScheduleOverrideRequest{
+		ScheduleIdentifier:     name,
+		ScheduleIdentifierType: schedule.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := []Shift{}
+	for _, item := range res.ScheduleOverride {
+		overrides = append(overrides, Shift{
+			ID:    item.Alias,
+			User:  item.User.Username,
+			Start: item.StartDate,
+			End:   item.EndDate,
+		})
+	}
+
+	return overrides, nil
+}
+
+// GetOverrideHistory reads the override timeline, the list of the overrides
+// has only the current and the upcoming ones
+func (p *opsgenieProvider) GetOverrideHistory(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	if err := p.initSchedule(); err != nil {
+		return nil, err
+	}
+
+	date := start.UTC()
+
+	res, err := p.sc.GetTimeline(ctx, &schedule.GetTimelineRequest{
+		Date:            &date,
+		Expands:         []schedule.ExpandType{schedule.Override},
+		IdentifierType:  schedule.Name,
+		IdentifierValue: name,
+		Interval:        int(end.Sub(start).Hours()/24) + 1,
+		IntervalUnit:    schedule.Days,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := []Shift{}
+	for _, rotation := range res.OverrideTimeline.Rotations {
+		for _, period := range rotation.Periods {
+			if period.Recipient.Type != og.User {
+				continue
+			}
+
+			overrides = append(overrides, Shift{
+				User:  period.Recipient.Name,
+				Start: period.StartDate,
+				End:   period.EndDate,
+			})
+		}
+	}
+
+	return overrides, nil
+}
+
+func (p *opsgenieProvider) DeleteOverride(ctx context.Context, name, id string) error {
+	if err := p.initSchedule(); err != nil {
+		return err
+	}
+
+	if _, err := p.sc.DeleteScheduleOverride(ctx, &schedule.DeleteScheduleOverrideRequest{
+		Alias:                  id,
+		ScheduleIdentifier:     name,
+		ScheduleIdentifierType: schedule.Name,
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetShifts reads the final timeline by days, the periods of all the
+// rotations are returned
+func (p *opsgenieProvider) GetShifts(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	if err := p.initSchedule(); err != nil {
+		return nil, err
+	}
+
+	days := int(end.Sub(start).Hours()/24) + 1
+
+	res, err := p.sc.GetTimeline(ctx, &schedule.GetTimelineRequest{
+		Date:            &start,
+		IdentifierType:  schedule.Name,
+		IdentifierValue: name,
+		Interval:        days,
+		IntervalUnit:    schedule.Days,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
+	shifts := []Shift{}
+	for _, rotation := range res.FinalTimeline.Rotations {
+		for _, period := range rotation.Periods {
+			if period.Recipient.Type != og.User || !period.EndDate.After(start) || !period.StartDate.Before(end) {
+				continue
+			}
+
+			shifts = append(shifts, Shift{
+				User:  period.Recipient.Name,
+				Start: period.StartDate,
+				End:   period.EndDate,
+			})
+		}
+	}
+
+	return shifts, nil
+}
+
+func (p *opsgenieProvider) CreateAlert(ctx context.Context, req AlertRequest) (string, error) {
+	if err := p.initAlert(); err != nil {
+		return "", err
+	}
 
-	res, err := s.ac.Create(ctx, &alert.CreateAlertRequest{
-		Description: fmt.Sprintf("slack:%s\n%s", thread_link, message),
-		Message:     "you were called in the slack",
-		Priority:    alert.Priority(viper.GetString("_opsgenie.priority")),
+	res, err := p.ac.Create(ctx, &alert.CreateAlertRequest{
+		Alias:       req.Alias,
+		Description: req.Description,
+		Details:     req.Details,
+		Entity:      req.Entity,
+		Message:     opsgenieTruncate(req.Message, 130),
+		Priority:    alert.Priority(req.Priority),
 		Responders: []alert.Responder{{
-			Name: s.list[0].name,
+			Name: req.Schedule,
 			Type: alert.ScheduleResponder,
 		}},
-		Tags: []string{pkg, s.list[0].group},
+		Source: req.Source,
+		Tags:   req.Tags,
 	})
 	if err != nil {
-		s.log.Error("failed to create an alert")
 		return "", err
 	}
 
-	req, err := res.RetrieveStatus(ctx)
+	status, err := res.RetrieveStatus(ctx)
 	if err != nil {
-		s.log.Error("failed to get an alert")
-		return "", err
+		return "", fmt.Errorf("failed to get an alert - %s", err)
 	}
 
-	return req.AlertID, nil
+	return status.AlertID, nil
 }
 
-func (s *Schedules) opsgenieCloseAlert(alertID string) error {
-	if err := s.opsgenieInitAlert(); err != nil {
+func (p *opsgenieProvider) CloseAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	if err := p.initAlert(); err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-
-	if _, err := s.ac.Close(ctx, &alert.CloseAlertRequest{
+	if _, err := p.ac.Close(ctx, &alert.CloseAlertRequest{
 		IdentifierType:  alert.ALERTID,
 		IdentifierValue: alertID,
+		Note:            update.Note,
+		Source:          update.Source,
+		User:            update.User,
 	}); err != nil {
 		return err
 	}
@@ -209,16 +380,49 @@ func (s *Schedules) opsgenieCloseAlert(alertID string) error {
 	return nil
 }
 
-func (s *Schedules) opsgenieAckAlert(alertID string) error {
-	if err := s.opsgenieInitAlert(); err != nil {
+func (p *opsgenieProvider) AlertClosed(ctx context.Context, alertID string) (bool, error) {
+	if err := p.initAlert(); err != nil {
+		return false, err
+	}
+
+	res, err := p.ac.Get(ctx, &alert.GetAlertRequest{
+		IdentifierType:  alert.ALERTID,
+		IdentifierValue: alertID,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.Status == "closed", nil
+}
+
+func (p *opsgenieProvider) AckAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	if err := p.initAlert(); err != nil {
+		return err
+	}
+
+	if _, err := p.ac.Acknowledge(ctx, &alert.AcknowledgeAlertRequest{
+		IdentifierType:  alert.ALERTID,
+		IdentifierValue: alertID,
+		Note:            update.Note,
+		Source:          update.Source,
+		User:            update.User,
+	}); err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	return nil
+}
 
-	if _, err := s.ac.Acknowledge(ctx, &alert.AcknowledgeAlertRequest{
+func (p *opsgenieProvider) SetAlertPriority(ctx context.Context, alertID, priority string) error {
+	if err := p.initAlert(); err != nil {
+		return err
+	}
+
+	if _, err := p.ac.UpdatePriority(ctx, &alert.UpdatePriorityRequest{
 		IdentifierType:  alert.ALERTID,
 		IdentifierValue: alertID,
+		Priority:        alert.Priority(priority),
 	}); err != nil {
 		return err
 	}
@@ -226,20 +430,55 @@ func (s *Schedules) opsgenieAckAlert(alertID string) error {
 	return nil
 }
 
-func (s *Schedules) opsgenieIncreaseAlertPriority(alertID, priority string) error {
-	if err := s.opsgenieInitAlert(); err != nil {
+func (p *opsgenieProvider) AddResponders(ctx context.Context, alertID string, responders []Responder) error {
+	if err := p.initAlert(); err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	for _, responder := range responders {
+		req := &alert.AddResponderRequest{
+			IdentifierType:  alert.ALERTID,
+			IdentifierValue: alertID,
+			Responder: alert.Responder{
+				Type: alert.ResponderType(responder.Type),
+				Name: responder.Name,
+			},
+		}
+
+		if responder.Type == "user" {
+			req.Responder.Name = ""
+			req.Responder.Username = responder.Name
+		}
+
+		if _, err := p.ac.AddResponder(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	if _, err := s.ac.UpdatePriority(ctx, &alert.UpdatePriorityRequest{
+func (p *opsgenieProvider) AddNote(ctx context.Context, alertID, note string) error {
+	if err := p.initAlert(); err != nil {
+		return err
+	}
+
+	if _, err := p.ac.AddNote(ctx, &alert.AddNoteRequest{
 		IdentifierType:  alert.ALERTID,
 		IdentifierValue: alertID,
-		Priority:        alert.Priority(priority),
+		Note:            note,
 	}); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// opsgenieTruncate cuts the text to the length limit of the opsgenie field
+func opsgenieTruncate(text string, limit int) string {
+	if r := []rune(text); len(r) > limit {
+		return string(r[:limit-1]) + "…"
+	}
+
+	return text
+}
@@ -0,0 +1,620 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const pagerdutyURL = "https://api.pagerduty.com"
+
+type pagerdutyProvider struct {
+	api_key string
+	from    string
+	service string
+
+	policies   map[string]string
+	priorities map[string]string
+	schedules  map[string]string
+}
+
+type pagerdutyReference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type pagerdutyUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+func newPagerdutyProvider(conf map[string]string) (*pagerdutyProvider, error) {
+	p := &pagerdutyProvider{
+		api_key: conf["api_key"],
+		from:    pagerdutyFrom(conf),
+		service: conf["service"],
+	}
+
+	if p.api_key == "" {
+		if p.api_key = viper.GetString("pagerduty.api.key"); p.api_key == "" {
+			return nil, fmt.Errorf("pagerduty API key is empty")
+		}
+	}
+
+	if p.service == "" {
+		p.service = viper.GetString("pagerduty.service")
+	}
+
+	return p, nil
+}
+
+// pagerdutyFrom is the pagerduty user the incidents are created on behalf of,
+// pagerduty rejects the incidents without it
+func pagerdutyFrom(conf map[string]string) string {
+	if from := conf["from"]; from != "" {
+		return from
+	}
+
+	return viper.GetString("pagerduty.from")
+}
+
+func (p *pagerdutyProvider) request(ctx context.Context, method, path string, in, out interface{}) error {
+	return p.requestFrom(ctx, p.from, method, path, in, out)
+}
+
+// requestFrom makes the request on behalf of the pagerduty user with the email
+func (p *pagerdutyProvider) requestFrom(ctx context.Context, from, method, path string, in, out interface{}) error {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	header.Set("Authorization", fmt.Sprintf("Token token=%s", p.api_key))
+
+	if from != "" {
+		header.Set("From", from)
+	}
+
+	return apiRequest(ctx, method, pagerdutyURL+path, header, in, out)
+}
+
+// scheduleID accepts both a schedule ID and a schedule name, the names are
+// resolved once and cached for the lifetime of the provider
+func (p *pagerdutyProvider) scheduleID(ctx context.Context, name string) (string, error) {
+	if p.schedules == nil {
+		p.schedules = make(map[string]string)
+	}
+
+	if id, ok := p.schedules[name]; ok {
+		return id, nil
+	}
+
+	var res struct {
+		Schedules []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"schedules"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/schedules?query="+url.QueryEscape(name), nil, &res); err != nil {
+		return "", err
+	}
+
+	id := name
+	for _, item := range res.Schedules {
+		if item.Name == name {
+			id = item.ID
+		}
+	}
+
+	p.schedules[name] = id
+
+	return id, nil
+}
+
+// schedulePolicy is the escalation policy the schedule is used in, the first
+// one when there are a few
+func (p *pagerdutyProvider) schedulePolicy(ctx context.Context, name string) (string, error) {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if p.policies == nil {
+		p.policies = make(map[string]string)
+	}
+
+	if policy, ok := p.policies[id]; ok {
+		return policy, nil
+	}
+
+	var res struct {
+		Schedule struct {
+			EscalationPolicies []pagerdutyReference `json:"escalation_policies"`
+		} `json:"schedule"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/schedules/"+id, nil, &res); err != nil {
+		return "", err
+	}
+
+	if len(res.Schedule.EscalationPolicies) < 1 {
+		return "", fmt.Errorf("pagerduty schedule %#v isn't used by any escalation policy", name)
+	}
+
+	p.policies[id] = res.Schedule.EscalationPolicies[0].ID
+
+	return p.policies[id], nil
+}
+
+func (p *pagerdutyProvider) userID(ctx context.Context, email string) (string, error) {
+	var res struct {
+		Users []pagerdutyUser `json:"users"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/users?query="+url.QueryEscape(email), nil, &res); err != nil {
+		return "", err
+	}
+
+	for _, user := range res.Users {
+		if strings.EqualFold(user.Email, email) {
+			return user.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("can't find pagerduty user %#v", email)
+}
+
+func (p *pagerdutyProvider) userEmail(ctx context.Context, id string) (string, error) {
+	var res struct {
+		User pagerdutyUser `json:"user"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/users/"+id, nil, &res); err != nil {
+		return "", err
+	}
+
+	return res.User.Email, nil
+}
+
+func (p *pagerdutyProvider) escalationPolicyID(ctx context.Context, name string) (string, error) {
+	var res struct {
+		EscalationPolicies []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"escalation_policies"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/escalation_policies?query="+url.QueryEscape(name), nil, &res); err != nil {
+		return "", err
+	}
+
+	for _, item := range res.EscalationPolicies {
+		if item.Name == name {
+			return item.ID, nil
+		}
+	}
+
+	return name, nil
+}
+
+// priority maps the Opsgenie style priority (P1-P5) to the priority of the
+// PagerDuty account, an empty reference means priorities are disabled
+func (p *pagerdutyProvider) priority(ctx context.Context, name string) (*pagerdutyReference, error) {
+	if p.priorities == nil {
+		var res struct {
+			Priorities []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"priorities"`
+		}
+
+		if err := p.request(ctx, http.MethodGet, "/priorities", nil, &res); err != nil {
+			return nil, err
+		}
+
+		p.priorities = make(map[string]string)
+		for _, item := range res.Priorities {
+			p.priorities[item.Name] = item.ID
+		}
+	}
+
+	id, ok := p.priorities[name]
+	if !ok {
+		return nil, nil
+	}
+
+	return &pagerdutyReference{ID: id, Type: "priority_reference"}, nil
+}
+
+func pagerdutyUrgency(priority string) string {
+	switch priority {
+	case "P1", "P2":
+		return "high"
+	default:
+		return "low"
+	}
+}
+
+// GetOnCalls returns the users of the schedule with the level of the schedule
+// in the escalation policies
+func (p *pagerdutyProvider) GetOnCalls(ctx context.Context, name string) ([]OnCall, error) {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Oncalls []struct {
+			EscalationLevel int           `json:"escalation_level"`
+			User            pagerdutyUser `json:"user"`
+		} `json:"oncalls"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/oncalls?include[]=users&schedule_ids[]="+url.QueryEscape(id), nil, &res); err != nil {
+		return nil, err
+	}
+
+	users := []OnCall{}
+	for _, oncall := range res.Oncalls {
+		level := 0
+		if oncall.EscalationLevel > 1 {
+			level = oncall.EscalationLevel - 1
+		}
+
+		users = append(users, OnCall{User: oncall.User.Email, Level: level})
+	}
+
+	return users, nil
+}
+
+// GetTeamMembers accepts both a team ID and a team name
+func (p *pagerdutyProvider) GetTeamMembers(ctx context.Context, name string) ([]string, error) {
+	var teams struct {
+		Teams []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"teams"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/teams?query="+url.QueryEscape(name), nil, &teams); err != nil {
+		return nil, err
+	}
+
+	id := name
+	for _, item := range teams.Teams {
+		if item.Name == name {
+			id = item.ID
+		}
+	}
+
+	var res struct {
+		Members []struct {
+			User pagerdutyUser `json:"user"`
+		} `json:"members"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, fmt.Sprintf("/teams/%s/members?include[]=users", id), nil, &res); err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, member := range res.Members {
+		users = append(users, member.User.Email)
+	}
+
+	return users, nil
+}
+
+func (p *pagerdutyProvider) CreateOverride(ctx context.Context, name, user string, start, end time.Time) error {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	uid, err := p.userID(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	return p.request(ctx, http.MethodPost, fmt.Sprintf("/schedules/%s/overrides", id), map[string]interface{}{
+		"overrides": []map[string]interface{}{{
+			"start": start.Format(time.RFC3339),
+			"end":   end.Format(time.RFC3339),
+			"user":  pagerdutyReference{ID: uid, Type: "user_reference"},
+		}},
+	}, nil)
+}
+
+// GetOverrides returns the overrides of the last week and the next month,
+// pagerduty needs the time range
+func (p *pagerdutyProvider) GetOverrides(ctx context.Context, name string) ([]Shift, error) {
+	return p.GetOverrideHistory(ctx, name, time.Now().AddDate(0, 0, -7), time.Now().AddDate(0, 1, 0))
+}
+
+func (p *pagerdutyProvider) GetOverrideHistory(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Overrides []struct {
+			ID    string             `json:"id"`
+			Start time.Time          `json:"start"`
+			End   time.Time          `json:"end"`
+			User  pagerdutyReference `json:"user"`
+		} `json:"overrides"`
+	}
+
+	query := url.Values{}
+	// the overrides crossing the range keep their own start and end
+	query.Set("overflow", "true")
+	query.Set("since", start.Format(time.RFC3339))
+	query.Set("until", end.Format(time.RFC3339))
+
+	if err := p.request(ctx, http.MethodGet, fmt.Sprintf("/schedules/%s/overrides?%s", id, query.Encode()), nil, &res); err != nil {
+		return nil, err
+	}
+
+	overrides := []Shift{}
+	for _, item := range res.Overrides {
+		email, err := p.userEmail(ctx, item.User.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, Shift{ID: item.ID, User: email, Start: item.Start, End: item.End})
+	}
+
+	return overrides, nil
+}
+
+func (p *pagerdutyProvider) DeleteOverride(ctx context.Context, name, override string) error {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return p.request(ctx, http.MethodDelete, fmt.Sprintf("/schedules/%s/overrides/%s", id, override), nil, nil)
+}
+
+func (p *pagerdutyProvider) GetShifts(ctx context.Context, name string, start, end time.Time) ([]Shift, error) {
+	id, err := p.scheduleID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Oncalls []struct {
+			User  pagerdutyUser `json:"user"`
+			Start *time.Time    `json:"start"`
+			End   *time.Time    `json:"end"`
+		} `json:"oncalls"`
+	}
+
+	query := url.Values{}
+	query.Set("include[]", "users")
+	query.Set("schedule_ids[]", id)
+	query.Set("since", start.Format(time.RFC3339))
+	query.Set("until", end.Format(time.RFC3339))
+
+	if err := p.request(ctx, http.MethodGet, "/oncalls?"+query.Encode(), nil, &res); err != nil {
+		return nil, err
+	}
+
+	shifts := []Shift{}
+	for _, oncall := range res.Oncalls {
+		shift := Shift{User: oncall.User.Email, Start: start, End: end}
+
+		// the permanent on-call has no start and end
+		if oncall.Start != nil {
+			shift.Start = *oncall.Start
+		}
+
+		if oncall.End != nil {
+			shift.End = *oncall.End
+		}
+
+		shifts = append(shifts, shift)
+	}
+
+	return shifts, nil
+}
+
+func (p *pagerdutyProvider) CreateAlert(ctx context.Context, req AlertRequest) (string, error) {
+	if p.service == "" {
+		return "", fmt.Errorf("pagerduty service is empty")
+	}
+
+	incident := map[string]interface{}{
+		"type":    "incident",
+		"title":   req.Message,
+		"service": pagerdutyReference{ID: p.service, Type: "service_reference"},
+		"urgency": pagerdutyUrgency(req.Priority),
+		"body": map[string]string{
+			"type":    "incident_body",
+			"details": strings.TrimSpace(req.Description + "\n\n" + req.detailsText()),
+		},
+	}
+
+	// an empty key would deduplicate all the alerts without a thread
+	if req.Alias != "" {
+		incident["incident_key"] = req.Alias
+	}
+
+	// the routed schedules are paged instead of the policy of the service
+	if req.Schedule != "" {
+		policy, err := p.schedulePolicy(ctx, req.Schedule)
+		if err != nil {
+			return "", err
+		}
+
+		incident["escalation_policy"] = pagerdutyReference{ID: policy, Type: "escalation_policy_reference"}
+	}
+
+	priority, err := p.priority(ctx, req.Priority)
+	if err != nil {
+		return "", err
+	}
+
+	if priority != nil {
+		incident["priority"] = priority
+	}
+
+	var res struct {
+		Incident struct {
+			ID string `json:"id"`
+		} `json:"incident"`
+	}
+
+	if err := p.request(ctx, http.MethodPost, "/incidents", map[string]interface{}{"incident": incident}, &res); err != nil {
+		return "", err
+	}
+
+	return res.Incident.ID, nil
+}
+
+func (p *pagerdutyProvider) updateIncident(ctx context.Context, alertID string, fields map[string]interface{}) error {
+	fields["type"] = "incident_reference"
+
+	return p.request(ctx, http.MethodPut, "/incidents/"+alertID, map[string]interface{}{"incident": fields}, nil)
+}
+
+// updateStatus changes the status on behalf of the chat user, the default
+// from is used when the user isn't known to pagerduty
+func (p *pagerdutyProvider) updateStatus(ctx context.Context, alertID, status string, update AlertUpdate) error {
+	body := map[string]interface{}{"incident": map[string]interface{}{
+		"type":   "incident_reference",
+		"status": status,
+	}}
+
+	err := p.requestFrom(ctx, update.User, http.MethodPut, "/incidents/"+alertID, body, nil)
+	if err != nil && update.User != "" && update.User != p.from {
+		err = p.request(ctx, http.MethodPut, "/incidents/"+alertID, body, nil)
+	}
+
+	if err != nil || update.Note == "" {
+		return err
+	}
+
+	return p.AddNote(ctx, alertID, update.Note)
+}
+
+func (p *pagerdutyProvider) CloseAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	return p.updateStatus(ctx, alertID, "resolved", update)
+}
+
+func (p *pagerdutyProvider) AlertClosed(ctx context.Context, alertID string) (bool, error) {
+	var res struct {
+		Incident struct {
+			Status string `json:"status"`
+		} `json:"incident"`
+	}
+
+	if err := p.request(ctx, http.MethodGet, "/incidents/"+alertID, nil, &res); err != nil {
+		return false, err
+	}
+
+	return res.Incident.Status == "resolved", nil
+}
+
+func (p *pagerdutyProvider) AckAlert(ctx context.Context, alertID string, update AlertUpdate) error {
+	return p.updateStatus(ctx, alertID, "acknowledged", update)
+}
+
+func (p *pagerdutyProvider) AddNote(ctx context.Context, alertID, note string) error {
+	return p.request(ctx, http.MethodPost, "/incidents/"+alertID+"/notes", map[string]interface{}{
+		"note": map[string]string{"content": note},
+	}, nil)
+}
+
+func (p *pagerdutyProvider) SetAlertPriority(ctx context.Context, alertID, priority string) error {
+	fields := map[string]interface{}{"urgency": pagerdutyUrgency(priority)}
+
+	reference, err := p.priority(ctx, priority)
+	if err != nil {
+		return err
+	}
+
+	if reference != nil {
+		fields["priority"] = reference
+	}
+
+	return p.updateIncident(ctx, alertID, fields)
+}
+
+// AddResponders sends responder requests, a team responder is the name or ID
+// of an escalation policy since pagerduty can't page a team directly
+func (p *pagerdutyProvider) AddResponders(ctx context.Context, alertID string, responders []Responder) error {
+	requester, err := p.userID(ctx, p.from)
+	if err != nil {
+		return err
+	}
+
+	targets := []map[string]interface{}{}
+
+	for _, responder := range responders {
+		var target pagerdutyReference
+
+		switch responder.Type {
+		case "user":
+			id, err := p.userID(ctx, responder.Name)
+			if err != nil {
+				return err
+			}
+
+			target = pagerdutyReference{ID: id, Type: "user_reference"}
+		case "team":
+			id, err := p.escalationPolicyID(ctx, responder.Name)
+			if err != nil {
+				return err
+			}
+
+			target = pagerdutyReference{ID: id, Type: "escalation_policy_reference"}
+		default:
+			return fmt.Errorf("unknown responder type %#v", responder.Type)
+		}
+
+		targets = append(targets, map[string]interface{}{"responder_request_target": target})
+	}
+
+	return p.request(ctx, http.MethodPost, fmt.Sprintf("/incidents/%s/responder_requests", alertID), map[string]interface{}{
+		"requester_id":              requester,
+		"message":                   "Please help with this incident",
+		"responder_request_targets": targets,
+	}, nil)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// slackFormCallback is the callback id of the "Page on-call" shortcuts and
+// of the form they open
+const slackFormCallback = "page_oncall"
+
+func slackText(text string) *slack.TextBlockObject {
+	return slack.NewTextBlockObject(slack.PlainTextType, text, false, false)
+}
+
+func slackOptions(values ...string) []*slack.OptionBlockObject {
+	options := []*slack.OptionBlockObject{}
+
+	for _, value := range values {
+		options = append(options, slack.NewOptionBlockObject(value, slackText(value), nil))
+	}
+
+	return options
+}
+
+func (c *slackBackend) OpenAlertForm(trigger string, opts AlertFormOptions) error {
+	blocks := []slack.Block{}
+
+	// the global shortcut doesn't know the channel
+	if opts.Channel == "" {
+		channel := slack.NewOptionsSelectBlockElement(slack.OptTypeConversations, nil, "channel")
+		channel.DefaultToCurrentConversation = true
+		channel.Filter = &slack.SelectBlockElementFilter{
+			Include:                       []string{"public", "private"},
+			ExcludeBotUsers:               true,
+			ExcludeExternalSharedChannels: true,
+		}
+
+		blocks = append(blocks, slack.NewInputBlock("channel", slackText("Channel"), channel))
+	}
+
+	summary := slack.NewPlainTextInputBlockElement(nil, "summary")
+	summary.MaxLength = 130 // the length of the opsgenie alert message
+
+	description := slack.NewPlainTextInputBlockElement(nil, "description")
+	description.Multiline = true
+
+	priority := slack.NewOptionsSelectBlockElement(slack.OptTypeStatic, nil, "priority", slackOptions("P1", "P2", "P3", "P4", "P5")...)
+	if opts.Priority != "" {
+		priority.InitialOption = slack.NewOptionBlockObject(opts.Priority, slackText(opts.Priority), nil)
+	}
+
+	schedule := slack.NewOptionsSelectBlockElement(slack.OptTypeStatic, nil, "schedule", slackOptions(opts.Schedules...)...)
+	if opts.Schedule != "" {
+		schedule.InitialOption = slack.NewOptionBlockObject(opts.Schedule, slackText(opts.Schedule), nil)
+	}
+
+	teams := slack.NewPlainTextInputBlockElement(slackText("sre, dba"), "teams")
+	users := slack.NewOptionsMultiSelectBlockElement(slack.MultiOptTypeUser, nil, "users")
+
+	descriptionBlock := slack.NewInputBlock("description", slackText("Description"), description)
+	descriptionBlock.Optional = true
+
+	teamsBlock := slack.NewInputBlock("teams", slackText("Extra teams"), teams)
+	teamsBlock.Optional = true
+
+	usersBlock := slack.NewInputBlock("users", slackText("Extra users"), users)
+	usersBlock.Optional = true
+
+	blocks = append(blocks,
+		slack.NewInputBlock("summary", slackText("Summary"), summary),
+		descriptionBlock,
+		slack.NewInputBlock("priority", slackText("Priority"), priority),
+		slack.NewInputBlock("schedule", slackText("Schedule"), schedule),
+		teamsBlock,
+		usersBlock,
+	)
+
+	_, err := c.client.OpenView(trigger, slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		Title:           slackText("Page on-call"),
+		Submit:          slackText("Page"),
+		Close:           slackText("Cancel"),
+		Blocks:          slack.Blocks{BlockSet: blocks},
+		CallbackID:      slackFormCallback,
+		PrivateMetadata: strings.Join([]string{opts.Channel, opts.Thread, opts.TimeStamp}, ";"),
+	})
+
+	return err
+}
+
+func (c *slackBackend) shortcutEvent(payload slack.InteractionCallback) (Event, bool) {
+	if payload.CallbackID != slackFormCallback {
+		return Event{}, false
+	}
+
+	e := Event{
+		Type:      "shortcut",
+		Data:      payload.TriggerID,
+		ChannelID: payload.Channel.ID,
+		UserID:    payload.User.ID,
+	}
+
+	// the message shortcut pages in the thread of the message
+	if payload.Type == slack.InteractionTypeMessageAction {
+		e.ThreadTimeStamp = payload.Message.ThreadTimestamp
+		e.TimeStamp = payload.Message.Timestamp
+	}
+
+	return e, true
+}
+
+func (c *slackBackend) formEvent(payload slack.InteractionCallback) (Event, bool) {
+	if payload.View.CallbackID != slackFormCallback || payload.View.State == nil {
+		return Event{}, false
+	}
+
+	values := payload.View.State.Values
+	value := func(block string) slack.BlockAction {
+		return values[block][block]
+	}
+
+	metadata := strings.Split(payload.View.PrivateMetadata, ";")
+	if len(metadata) < 3 {
+		return Event{}, false
+	}
+
+	e := Event{
+		Type:            "mention",
+		ChannelID:       metadata[0],
+		Data:            value("description").Value,
+		ThreadTimeStamp: metadata[1],
+		TimeStamp:       metadata[2],
+		UserID:          payload.User.ID,
+		Form: &AlertForm{
+			Priority: value("priority").SelectedOption.Value,
+			Schedule: value("schedule").SelectedOption.Value,
+			Summary:  value("summary").Value,
+			Teams:    []string{},
+			Users:    value("users").SelectedUsers,
+		},
+	}
+
+	if e.ChannelID == "" {
+		e.ChannelID = value("channel").SelectedConversation
+	}
+
+	for _, team := range strings.FieldsFunc(value("teams").Value, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		e.Form.Teams = appendUnique(e.Form.Teams, team)
+	}
+
+	return e, true
+}
@@ -33,638 +33,459 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/signal"
 	"strings"
-	"syscall"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
 	"github.com/slack-go/slack/socketmode"
 	"github.com/spf13/viper"
-	"golang.org/x/exp/slices"
 )
 
-var priority_auto_increase_alert map[string]bool
+type slackBackend struct {
+	bot            string
+	group          string
+	team           string
+	signing_secret string
 
-func (s *Schedules) slackInit() error {
-	if s.slack != nil {
-		return nil
-	}
+	client *slack.Client
+	events chan Event
+	seen   seenEvents
+	sm     *socketmode.Client
+
+	log *log.Entry
+}
 
+func newSlackBackend(group string, conf map[string]string, logger *log.Entry) (*slackBackend, error) {
 	var (
-		slack_app_key string // xapp
-		slack_api_key string // xoxp or xoxb
-		slack_type    string
+		slack_app_key        = conf["app_key"] // xapp
+		slack_api_key        = conf["api_key"] // xoxp or xoxb
+		slack_signing_secret = conf["signing_secret"]
 	)
 
-	switch s.mode {
-	case "daemon":
-		priority_auto_increase_alert = make(map[string]bool)
-		slack_api_key = s.list[0].api_key
-		slack_app_key = s.list[0].app_key
-		slack_type = "appname"
-	case "sync":
-		slack_api_key = viper.GetString("slack.api.key")
-		slack_type = "usergroup"
-	default:
-		return fmt.Errorf("unknown app mode")
+	if slack_signing_secret == "" {
+		slack_signing_secret = viper.GetString("slack.signing.secret")
 	}
 
-	s.log = log.WithFields(log.Fields{
-		slack_type: s.list[0].group,
-		"schedule": s.list[0].name,
-	})
-
-	s.log.Info("init slack client")
-
-	s.slack = slack.New(
-		slack_api_key,
-		slack.OptionAppLevelToken(slack_app_key),
-		// slack.OptionDebug(true),
-	)
-
-	return nil
-}
-
-func (s *Schedules) slackClientsWS() error {
-	for _, item := range s.list {
-		schedule := Schedules{
-			list: []Schedule{item},
-			mode: s.mode,
-		}
-
-		if err := schedule.slackConnectToWS(); err != nil {
-			return err
+	if slack_api_key == "" {
+		if slack_api_key = viper.GetString("slack.api.key"); slack_api_key == "" {
+			return nil, fmt.Errorf("slack API key is empty")
 		}
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	sig := <-sigs
-
-	log.WithFields(log.Fields{
-		"signal": sig.String(),
-		"code":   fmt.Sprintf("%d", sig),
-	}).Info("Signal notify")
-
-	return nil
+	return &slackBackend{
+		client: slack.New(
+			slack_api_key,
+			slack.OptionAppLevelToken(slack_app_key),
+			slack.OptionHTTPClient(apiClient),
+			// slack.OptionDebug(true),
+		),
+		group:          group,
+		log:            logger,
+		signing_secret: slack_signing_secret,
+	}, nil
 }
 
-func (s *Schedules) slackConnectToWS() error {
-	if err := s.slackInit(); err != nil {
+func (c *slackBackend) Run(handler func(Event)) error {
+	auth, err := c.client.AuthTest()
+	if err != nil {
 		return err
 	}
 
-	if _, err := s.slack.AuthTest(); err != nil {
-		return err
+	c.bot = auth.UserID
+	c.team = auth.Team
+
+	if daemonTransport == "http" {
+		return c.runHTTP(handler)
 	}
 
-	s.sm = socketmode.New(
-		s.slack,
+	c.sm = socketmode.New(
+		c.client,
 		// socketmode.OptionDebug(true),
 	)
 
-	go s.slackWatchEvents()
+	go c.watchEvents(handler)
 
-	go s.sm.Run()
+	go c.sm.Run()
 
 	return nil
 }
 
-func (s *Schedules) slackGetAttachmentAction(action ...string) []slack.AttachmentAction {
-	actionList := []slack.AttachmentAction{}
+func (c *slackBackend) blockActions(confirm string, action ...string) []slack.BlockElement {
+	actionList := []slack.BlockElement{}
 
 	for _, item := range action {
+		var button *slack.ButtonBlockElement
+
 		switch item {
 		case "alert_increase_priority":
-			action := slack.AttachmentAction{
-				Name:  "alert_increase_priority",
-				Style: "danger",
-				Text:  "Increase priority",
-				Type:  "button",
-				Value: "alert_increase_priority",
-			}
-
-			if viper.GetBool("_opsgenie.priority_increase.confirm") {
-				action.Confirm = &slack.ConfirmationField{
-					Text: viper.GetString("_opsgenie.messages.alert_increase_priority.tip"),
-				}
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Increase priority", false, false))
+			button.Style = slack.StyleDanger
+
+			if confirm != "" {
+				button.Confirm = slack.NewConfirmationBlockObject(
+					slack.NewTextBlockObject(slack.PlainTextType, "Increase priority", false, false),
+					slack.NewTextBlockObject(slack.MarkdownType, confirm, false, false),
+					slack.NewTextBlockObject(slack.PlainTextType, "Yes", false, false),
+					slack.NewTextBlockObject(slack.PlainTextType, "No", false, false),
+				)
 			}
-
-			actionList = append(actionList, action)
 		case "alert_acknowledge":
-			actionList = append(actionList, slack.AttachmentAction{
-				Name:  "alert_acknowledge",
-				Text:  "Ack",
-				Type:  "button",
-				Value: "alert_acknowledge",
-			})
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Ack", false, false))
 		case "alert_close":
-			actionList = append(actionList, slack.AttachmentAction{
-				Name:  "alert_close",
-				Style: "primary",
-				Text:  "Close",
-				Type:  "button",
-				Value: "alert_close",
-			})
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Close", false, false))
+			button.Style = slack.StylePrimary
+		case "swap_accept":
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Accept", false, false))
+			button.Style = slack.StylePrimary
+		case "swap_decline":
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Decline", false, false))
+		case "take_confirm":
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Confirm", false, false))
+			button.Style = slack.StylePrimary
+		case "take_cancel":
+			button = slack.NewButtonBlockElement(item, item, slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false))
 		default:
 			continue
 		}
+
+		actionList = append(actionList, button)
 	}
 
 	return actionList
 }
 
-func (s *Schedules) slackGetAttachmentFields(priority, duty string, priorityAutoIncrease int) []slack.AttachmentField {
-	timeFormated := fmt.Sprintf("%02d:%02d", priorityAutoIncrease/60, priorityAutoIncrease%60)
+// blocks renders the alert card, the alert id and its priority are kept in the
+// block id of the actions block
+func (c *slackBackend) blocks(msg AlertMessage) []slack.Block {
+	var (
+		blocks  = []slack.Block{}
+		context = []slack.MixedElement{}
+		fields  = []*slack.TextBlockObject{}
+	)
 
-	attachmentField := []slack.AttachmentField{
-		{Short: true, Title: viper.GetString("_opsgenie.messages.fields.priority"), Value: priority},
-		{Short: true, Title: viper.GetString("_opsgenie.messages.fields.on_duty"), Value: fmt.Sprintf("<@%s>", duty)},
+	if msg.Text != "" {
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, msg.Text, false, false), nil, nil))
 	}
 
-	if priorityAutoIncrease > 0 {
-		attachmentField = append(
-			attachmentField,
-			slack.AttachmentField{
-				Short: true,
-				Title: strings.Replace(viper.GetString("_opsgenie.messages.fields.priority_p1_after"), "_time_", timeFormated, -1),
-			},
-		)
+	for _, field := range msg.Fields {
+		// the fields without a value are notes like the escalation countdown
+		if field.Value == "" {
+			context = append(context, slack.NewTextBlockObject(slack.MarkdownType, field.Title, false, false))
+			continue
+		}
+
+		fields = append(fields, slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*%s*\n%s", field.Title, field.Value), false, false))
 	}
 
-	return attachmentField
+	if len(fields) > 0 {
+		blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+	}
+
+	if len(context) > 0 {
+		blocks = append(blocks, slack.NewContextBlock("", context...))
+	}
+
+	if actions := c.blockActions(msg.Confirm, msg.Actions...); len(actions) > 0 {
+		blocks = append(blocks, slack.NewActionBlock(fmt.Sprintf("%s;%s", msg.AlertID, msg.Priority), actions...))
+	}
+
+	return blocks
+}
+
+// attachment keeps the color bar of the alert card around the blocks
+func (c *slackBackend) attachment(msg AlertMessage) slack.Attachment {
+	return slack.Attachment{
+		Blocks:   slack.Blocks{BlockSet: c.blocks(msg)},
+		Color:    msg.Color,
+		Fallback: msg.Text,
+	}
 }
 
-func (s *Schedules) slackWatchEvents() {
-	for envelope := range s.sm.Events {
+func (c *slackBackend) watchEvents(handler func(Event)) {
+	for envelope := range c.sm.Events {
 		switch envelope.Type {
 		case
 			socketmode.EventTypeEventsAPI,
 			socketmode.EventTypeInteractive,
 			socketmode.EventTypeSlashCommand:
-			s.log.Debugf("event type: %v", envelope.Type)
+			c.log.Debugf("event type: %v", envelope.Type)
 		default:
-			s.log.Debugf("skipped: %v", envelope.Type)
-			continue
-		}
-
-		s.sm.Ack(*envelope.Request)
-
-		s.log.Debugf("getting schedule - %#v", s.list[0].name)
-		if err := s.opsgenieGetSchedules(s.list[0].name); err != nil {
-			s.log.Errorf("can't load schedule - %s", err.Error())
-
+			c.log.Debugf("skipped: %v", envelope.Type)
 			continue
 		}
 
-		s.log.Debug("getting slack users")
-		if err := s.slackFindUsers(); err != nil {
-			s.log.Errorf("can't load slack users - %s", err.Error())
+		c.sm.Ack(*envelope.Request)
 
-			continue
-		}
-
-		e := Event{
-			OnDuty: s.list[0].duty[0],
-		}
+		var (
+			e  Event
+			ok bool
+		)
 
 		switch envelope.Type {
 		case socketmode.EventTypeInteractive:
 			payload, _ := envelope.Data.(slack.InteractionCallback)
-
-			switch payload.ActionCallback.AttachmentActions[0].Value {
-			case
-				"alert_acknowledge",
-				"alert_close",
-				"alert_increase_priority":
-			default:
-				continue
-			}
-
-			alert := strings.Split(payload.CallbackID, ";")
-
-			e.Action = payload.ActionCallback.AttachmentActions[0].Value
-			e.AlertID = alert[0]
-			e.AlertPriority = alert[1]
-			e.ChannelID = payload.Channel.GroupConversation.Conversation.ID
-			e.ResponseURL = payload.ResponseURL
-			e.UserID = payload.User.ID
-			s.Interactive(e)
-
+			e, ok = c.interactiveEvent(payload)
 		case socketmode.EventTypeEventsAPI:
 			payload, _ := envelope.Data.(slackevents.EventsAPIEvent)
-
-			switch event := payload.InnerEvent.Data.(type) {
-			case *slackevents.AppMentionEvent:
-				var msg slackevents.MessageEvent
-
-				json.Unmarshal([]byte(*payload.Data.(*slackevents.EventsAPICallbackEvent).InnerEvent), &msg)
-
-				if msg.Edited != nil {
-					continue
-				}
-
-				e.ChannelID = event.Channel
-				e.Data = event.Text
-				e.ThreadTimeStamp = event.ThreadTimeStamp
-				e.TimeStamp = event.TimeStamp
-				s.EventsApi(e)
-			}
-
+			e, ok = c.eventsAPIEvent(payload)
 		case socketmode.EventTypeSlashCommand:
 			payload, _ := envelope.Data.(slack.SlashCommand)
+			e, ok = c.commandEvent(payload), true
+		}
 
-			e.Action = "SlashCommand"
-			e.ChannelID = payload.ChannelID
-			e.Data = payload.Text
-			e.UserID = payload.UserID
-			s.SlashCommand(e)
+		if ok {
+			handler(e)
 		}
 	}
 }
 
-func (s *Schedules) EventsApi(e Event) {
-	var (
-		priority_auto_increase = viper.GetInt("_opsgenie.priority_increase.timer")
-		slackAttachmentAction  = s.slackGetAttachmentAction("alert_increase_priority", "alert_acknowledge", "alert_close")
-		slackAttachmentField   = s.slackGetAttachmentFields(viper.GetString("_opsgenie.priority"), e.OnDuty, priority_auto_increase)
-		slackAttachmentColor   = "warning"
-		slackResponse          = viper.GetString("_opsgenie.messages.alert_create.success")
-	)
-
-	s.log.Debug("getting permalink")
-	link, err := s.slack.GetPermalink(&slack.PermalinkParameters{
-		Channel: e.ChannelID,
-		Ts:      e.TimeStamp,
-	})
-	if err != nil {
-		s.log.Errorf("can't get permalink - %s", err.Error())
-
-		return
+func (c *slackBackend) interactiveEvent(payload slack.InteractionCallback) (Event, bool) {
+	switch payload.Type {
+	case slack.InteractionTypeShortcut, slack.InteractionTypeMessageAction:
+		return c.shortcutEvent(payload)
+	case slack.InteractionTypeViewSubmission:
+		return c.formEvent(payload)
 	}
 
-	ts := e.TimeStamp
-	if e.ThreadTimeStamp != "" {
-		ts = e.ThreadTimeStamp
+	if payload.Type != slack.InteractionTypeBlockActions || len(payload.ActionCallback.BlockActions) < 1 {
+		return Event{}, false
 	}
 
-	s.log.Debug("adding opsgenie alert")
-	alertID, err := s.opsgenieAddAlert(e.Data, ts, link)
-	if err != nil {
-		slackAttachmentAction = []slack.AttachmentAction{}
-		slackAttachmentField = []slack.AttachmentField{}
-		slackResponse = viper.GetString("_opsgenie.messages.alert_create.failure")
+	action := payload.ActionCallback.BlockActions[0]
 
-		s.log.Errorf("can't create alert - %s", err.Error())
+	switch action.ActionID {
+	case
+		"alert_acknowledge",
+		"alert_close",
+		"alert_increase_priority",
+		"swap_accept",
+		"swap_decline",
+		"take_cancel",
+		"take_confirm":
+	default:
+		return Event{}, false
 	}
 
-	s.log.Debugf("sending slack.PostMessage to %s", e.UserID)
-	_, respTS, err := s.slack.PostMessage(
-		e.ChannelID,
-		slack.MsgOptionTS(e.TimeStamp),
-		slack.MsgOptionAttachments(slack.Attachment{
-			Actions:    slackAttachmentAction,
-			CallbackID: fmt.Sprintf("%s;%s", alertID, viper.GetString("_opsgenie.priority")),
-			Color:      slackAttachmentColor,
-			Fields:     slackAttachmentField,
-			Text:       strings.Replace(slackResponse, "_user_", fmt.Sprintf("<@%s>", e.UserID), -1),
-		}),
-	)
-	if err != nil {
-		s.log.Error(err, respTS)
+	alert := strings.Split(action.BlockID, ";")
+	if len(alert) < 2 {
+		return Event{}, false
 	}
 
-	if priority_auto_increase > 0 {
-		go s.AlertPriorityAutoIncrease(Event{
-			AlertID:       alertID,
-			ChannelID:     e.ChannelID,
-			TimeStamp:     respTS,
-			IncreaseTimer: priority_auto_increase,
-			OnDuty:        e.OnDuty,
-		})
-	}
+	return Event{
+		Type:          "interactive",
+		Action:        action.ActionID,
+		AlertID:       alert[0],
+		AlertPriority: alert[1],
+		ChannelID:     payload.Container.ChannelID,
+		TimeStamp:     payload.Container.MessageTs,
+		UserID:        payload.User.ID,
+	}, true
 }
 
-func (s *Schedules) AlertPriorityAutoIncrease(e Event) {
-	var (
-		slackAttachmentAction = s.slackGetAttachmentAction("alert_increase_priority", "alert_acknowledge", "alert_close")
-		slackAttachmentColor  = "warning"
-		slackAttachmentField  = s.slackGetAttachmentFields(viper.GetString("_opsgenie.priority"), s.list[0].duty[0], e.IncreaseTimer)
-		slackResponse         = viper.GetString("_opsgenie.messages.alert_create.success")
-	)
+func (c *slackBackend) eventsAPIEvent(payload slackevents.EventsAPIEvent) (Event, bool) {
+	switch event := payload.InnerEvent.Data.(type) {
+	case *slackevents.AppMentionEvent:
+		var msg slackevents.MessageEvent
 
-	priority := viper.GetString("_opsgenie.priority")
-	priority_auto_increase_alert[e.AlertID] = true
+		json.Unmarshal([]byte(*payload.Data.(*slackevents.EventsAPICallbackEvent).InnerEvent), &msg)
 
-	for curTime := e.IncreaseTimer; curTime >= 0; curTime-- {
-		if !priority_auto_increase_alert[e.AlertID] {
-			return
+		if msg.Edited != nil {
+			return Event{}, false
 		}
 
-		if curTime == 0 {
-			slackAttachmentColor = "danger"
-			priority = "P1"
-
-			if err := s.opsgenieIncreaseAlertPriority(e.AlertID, priority); err != nil {
-				slackResponse = viper.GetString("_opsgenie.messages.alert_increase_priority.failure")
-
-				s.log.Errorf("can't close alert - %s", err.Error())
-			} else {
-				slackAttachmentAction = s.slackGetAttachmentAction("alert_acknowledge", "alert_close")
-			}
+		return Event{
+			Type:            "mention",
+			ChannelID:       event.Channel,
+			Data:            event.Text,
+			ThreadTimeStamp: event.ThreadTimeStamp,
+			TimeStamp:       event.TimeStamp,
+			UserID:          event.User,
+		}, true
+	case *slackevents.ReactionAddedEvent:
+		// only the reactions on the alert messages of the bot
+		if event.Item.Type != "message" || event.ItemUser != c.bot {
+			return Event{}, false
 		}
 
-		slackAttachmentField = s.slackGetAttachmentFields(priority, e.OnDuty, curTime)
-
-		if curTime%5 == 0 {
-			_, _, _, err := s.slack.UpdateMessage(
-				e.ChannelID,
-				e.TimeStamp,
-				slack.MsgOptionAttachments(slack.Attachment{
-					Actions:    slackAttachmentAction,
-					CallbackID: fmt.Sprintf("%s;%s", e.AlertID, priority),
-					Color:      slackAttachmentColor,
-					Fields:     slackAttachmentField,
-					Text:       slackResponse,
-				}),
-			)
-			if err != nil {
-				s.log.Error(err)
-			}
+		return Event{
+			Type:      "reaction",
+			ChannelID: event.Item.Channel,
+			Data:      event.Reaction,
+			TimeStamp: event.Item.Timestamp,
+			UserID:    event.User,
+		}, true
+	case *slackevents.MessageEvent:
+		switch event.SubType {
+		case "", "bot_message", "file_share", "thread_broadcast":
+		default:
+			return Event{}, false
 		}
 
-		time.Sleep(1 * time.Second)
-	}
-}
-
-func (s *Schedules) Interactive(e Event) {
-	var (
-		slackAttachmentAction []slack.AttachmentAction
-		slackAttachmentColor  string
-		slackAttachmentField  = s.slackGetAttachmentFields(e.AlertPriority, e.OnDuty, 0)
-		slackResponse         string
-	)
-
-	delete(priority_auto_increase_alert, e.AlertID)
-
-	switch e.Action {
-	case "alert_close":
-		slackAttachmentColor = "good"
-		slackResponse = viper.GetString("_opsgenie.messages.alert_close.success")
-
-		if err := s.opsgenieCloseAlert(e.AlertID); err != nil {
-			slackResponse = viper.GetString("_opsgenie.messages.alert_close.failure")
-
-			s.log.Errorf("can't close alert - %s", err.Error())
-		} else {
-			slackAttachmentAction = []slack.AttachmentAction{}
+		// the replies in threads become the alert notes, the mentions are
+		// already received as app_mention
+		if event.ThreadTimeStamp == "" || event.ThreadTimeStamp == event.TimeStamp ||
+			event.User == c.bot || strings.Contains(event.Text, c.Mention(c.bot)) {
+			return Event{}, false
 		}
-	case "alert_acknowledge":
-		slackAttachmentColor = "#039be5"
-		slackResponse = viper.GetString("_opsgenie.messages.alert_acknowledged.success")
 
-		if err := s.opsgenieAckAlert(e.AlertID); err != nil {
-			slackResponse = viper.GetString("_opsgenie.messages.alert_acknowledged.failure")
-
-			s.log.Errorf("can't ack alert - %s", err.Error())
-		} else {
-			slackAttachmentAction = s.slackGetAttachmentAction("alert_close")
-		}
-	case "alert_increase_priority":
-		e.AlertPriority = "P1"
-
-		slackAttachmentField = s.slackGetAttachmentFields(e.AlertPriority, s.list[0].duty[0], 0)
-		slackAttachmentColor = "danger"
-		slackResponse = viper.GetString("_opsgenie.messages.alert_increase_priority.success")
-
-		if err := s.opsgenieIncreaseAlertPriority(e.AlertID, e.AlertPriority); err != nil {
-			slackResponse = viper.GetString("_opsgenie.messages.alert_increase_priority.failure")
-
-			s.log.Errorf("can't close alert - %s", err.Error())
-		} else {
-			slackAttachmentAction = s.slackGetAttachmentAction("alert_acknowledge", "alert_close")
-		}
+		return Event{
+			Type:            "reply",
+			Bot:             event.BotID != "",
+			ChannelID:       event.Channel,
+			Data:            event.Text,
+			ThreadTimeStamp: event.ThreadTimeStamp,
+			TimeStamp:       event.TimeStamp,
+			UserID:          event.User,
+		}, true
 	}
 
-	if _, _, err := s.slack.PostMessage(
-		e.ChannelID,
-		slack.MsgOptionReplaceOriginal(e.ResponseURL),
-		slack.MsgOptionAttachments(slack.Attachment{
-			Actions:    slackAttachmentAction,
-			CallbackID: fmt.Sprintf("%s;%s", e.AlertID, e.AlertPriority),
-			Color:      slackAttachmentColor,
-			Fields:     slackAttachmentField,
-			Text:       strings.Replace(slackResponse, "_user_", fmt.Sprintf("<@%s>", e.UserID), -1),
-		}),
-	); err != nil {
-		s.log.Error(err)
-	}
+	return Event{}, false
 }
 
-func (s *Schedules) SlashCommand(e Event) {
-	data := strings.Split(e.Data, " ")
-	response := ""
-
-	if len(data) < 2 {
-		data = append(data, "")
-	}
-
-	switch data[0] {
-	case "take":
-		response = viper.GetString("_opsgenie.messages.command.duty_transferred")
-
-		if err := s.SlashCommandTake(e); err != nil {
-			response = fmt.Sprintf(":bangbang: `%s`", err)
-		}
-	case "w", "who":
-		response = viper.GetString("_opsgenie.messages.command.on_duty")
-	case "":
-		response = viper.GetString("_opsgenie.messages.command.help")
-	default:
-		response = viper.GetString("_opsgenie.messages.command.unknown")
+func (c *slackBackend) commandEvent(payload slack.SlashCommand) Event {
+	return Event{
+		Type:      "command",
+		Action:    "SlashCommand",
+		ChannelID: payload.ChannelID,
+		Data:      payload.Text,
+		UserID:    payload.UserID,
 	}
+}
 
-	for k, v := range map[string]string{
-		"_user_": fmt.Sprintf("<@%s>", e.OnDuty),
-		"_time_": data[1],
-	} {
-		response = strings.Replace(response, k, v, -1)
+func (c *slackBackend) GetChannelName(channel string) (string, error) {
+	info, err := c.client.GetConversationInfo(channel, false)
+	if err != nil {
+		return "", err
 	}
 
-	if _, err := s.slack.PostEphemeral(
-		e.ChannelID,
-		e.UserID,
-		slack.MsgOptionText(response, false),
-	); err != nil {
-		s.log.Error(err)
-	}
+	return info.Name, nil
 }
 
-func (s *Schedules) SlashCommandTake(e Event) error {
-	data := strings.Split(e.Data, " ")
-	response := viper.GetString("_opsgenie.messages.command.duty_was_taken")
-
-	if len(data) < 2 {
-		data = append(data, "")
-	}
-
-	if data[1] == "" {
-		return fmt.Errorf("to use the command, enter the time in the format 1.5h or 2h45m")
-	}
+func (c *slackBackend) GetPermalink(channel, ts string) (string, error) {
+	return c.client.GetPermalink(&slack.PermalinkParameters{
+		Channel: channel,
+		Ts:      ts,
+	})
+}
 
-	duration, err := time.ParseDuration(data[1])
-	if err != nil {
-		return err
-	}
+func (c *slackBackend) PostAlert(channel, thread string, msg AlertMessage) (string, error) {
+	_, ts, err := c.client.PostMessage(
+		channel,
+		slack.MsgOptionTS(thread),
+		slack.MsgOptionAttachments(c.attachment(msg)),
+	)
 
-	list, err := s.slack.GetUserGroupMembers(s.list[0].filter)
-	if err != nil {
-		return err
-	}
+	return ts, err
+}
 
-	if !slices.Contains(list, e.UserID) {
-		return fmt.Errorf("permission denied")
-	}
+func (c *slackBackend) UpdateAlert(channel, ts string, msg AlertMessage) error {
+	_, _, _, err := c.client.UpdateMessage(
+		channel,
+		ts,
+		slack.MsgOptionAttachments(c.attachment(msg)),
+	)
 
-	u, err := s.slack.GetUserInfo(e.UserID)
-	if err != nil {
-		return err
-	}
+	return err
+}
 
-	if u.Profile.Email == "" {
-		return fmt.Errorf("your email is empty")
-	}
+func (c *slackBackend) PostMessage(channel, text string) error {
+	_, _, err := c.client.PostMessage(
+		channel,
+		slack.MsgOptionText(text, false),
+	)
 
-	if err := s.opsgenieOverrideSchedules(
-		u.Profile.Email,
-		duration,
-	); err != nil {
-		return err
-	}
+	return err
+}
 
-	for k, v := range map[string]string{
-		"_user_": fmt.Sprintf("<@%s>", e.UserID),
-		"_time_": data[1],
-	} {
-		response = strings.Replace(response, k, v, -1)
-	}
+func (c *slackBackend) PostEphemeral(channel, user, text string) error {
+	_, err := c.client.PostEphemeral(
+		channel,
+		user,
+		slack.MsgOptionText(text, false),
+	)
 
-	if _, _, err := s.slack.PostMessage(
-		e.ChannelID,
-		slack.MsgOptionText(response, false),
-	); err != nil {
-		return err
-	}
+	return err
+}
 
-	return nil
+func (c *slackBackend) Mention(user string) string {
+	return fmt.Sprintf("<@%s>", user)
 }
 
-func (s *Schedules) slackUpdateUserGroup() error {
-	if err := s.slackInit(); err != nil {
-		return err
+func (c *slackBackend) GetUserGroups() (map[string]string, error) {
+	groups, err := c.client.GetUserGroups()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := s.slackGetUserGroups(); err != nil {
-		log.Fatal(err)
-	}
+	list := make(map[string]string)
 
-	if err := s.slackFindUsers(); err != nil {
-		log.Fatal(err)
+	for _, group := range groups {
+		list[group.Handle] = group.ID
 	}
 
-	for _, item := range s.list {
-		if item.group == "" {
-			continue
-		}
-
-		duty := []string{}
-
-		for _, uid := range item.finalDuty {
-			if uid == "" {
-				continue
-			}
-
-			duty = append(duty, uid)
-		}
-
-		if len(duty) < 1 {
-			s.log.Warn("there are no on-duty on this calendar")
+	return list, nil
+}
 
-			continue
-		}
+func (c *slackBackend) GetUserGroupMembers(group string) ([]string, error) {
+	return c.client.GetUserGroupMembers(group)
+}
 
-		if _, err := s.slack.UpdateUserGroupMembers(item.group, strings.Join(duty, ",")); err != nil {
-			s.log.Error(err)
+func (c *slackBackend) UpdateUserGroupMembers(group string, members []string) error {
+	_, err := c.client.UpdateUserGroupMembers(group, strings.Join(members, ","))
 
-			continue
-		}
+	return err
+}
 
-		s.log.Infof("the user group has been updated")
+func (c *slackBackend) GetUserByEmail(email string) (string, error) {
+	user, err := c.client.GetUserByEmail(email)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return user.ID, nil
 }
 
-func (s *Schedules) slackGetUserGroups() error {
-	if err := s.slackInit(); err != nil {
-		return err
+func (c *slackBackend) GetUserEmail(user string) (string, error) {
+	u, err := c.client.GetUserInfo(user)
+	if err != nil {
+		return "", err
 	}
 
-	s.groups = make(map[string]string)
+	return u.Profile.Email, nil
+}
 
-	groups, err := s.slack.GetUserGroups()
+func (c *slackBackend) GetUserName(user string) (string, error) {
+	u, err := c.client.GetUserInfo(user)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	for _, group := range groups {
-		s.groups[group.Handle] = group.ID
+	if u.RealName != "" {
+		return u.RealName, nil
 	}
 
-	s.log.Debugf("slack user groups: %#v", s.groups)
-
-	for idx, item := range s.list {
-		if len(item.duty) < 1 {
-			continue
-		}
-
-		group, ok := s.groups[item.group]
-		if !ok {
-			s.log.Errorf("can't find group id")
-		}
+	return u.Name, nil
+}
 
-		s.list[idx].group = group
+func (c *slackBackend) GetUserLocale(user string) (string, error) {
+	u, err := c.client.GetUserInfo(user)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return u.Locale, nil
 }
 
-func (s *Schedules) slackFindUsers() error {
-	if err := s.slackInit(); err != nil {
-		return err
+func (c *slackBackend) GetUserTimezone(user string) (string, error) {
+	u, err := c.client.GetUserInfo(user)
+	if err != nil {
+		return "", err
 	}
 
-	for _, item := range s.list {
-		if len(item.finalDuty) < 1 {
-			continue
-		}
-
-		for idx, duty := range item.finalDuty {
-			user, err := s.slack.GetUserByEmail(duty)
-			if err != nil {
-				s.log.Warnf("can't find user %#v", duty)
-
-				user = &slack.User{} // the user will be removed from duty
-			}
-
-			item.finalDuty[idx] = user.ID
-		}
-	}
+	return u.TZ, nil
+}
 
-	return nil
+func (c *slackBackend) Workspace() string {
+	return c.team
 }
@@ -0,0 +1,219 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// runHTTP serves the Events API, the interactivity and the slash command
+// requests on the daemon HTTP listener instead of the socket mode
+func (c *slackBackend) runHTTP(handler func(Event)) error {
+	if c.signing_secret == "" {
+		return fmt.Errorf("slack signing secret is empty")
+	}
+
+	c.events = make(chan Event, 100)
+
+	daemonHandle(fmt.Sprintf("/slack/%s/events", c.group), c.handleEvents)
+	daemonHandle(fmt.Sprintf("/slack/%s/interactive", c.group), c.handleInteractive)
+	daemonHandle(fmt.Sprintf("/slack/%s/command", c.group), c.handleCommand)
+
+	go func() {
+		for e := range c.events {
+			handler(e)
+		}
+	}()
+
+	return nil
+}
+
+// slackEventTTL is how long the received event ids are kept, slack retries an
+// event for a few minutes
+const slackEventTTL = 10 * time.Minute
+
+// seenEvents is the ids of the received events
+type seenEvents struct {
+	mu   sync.Mutex
+	list map[string]time.Time
+}
+
+// add is whether the event wasn't received yet, the expired ids are dropped
+func (e *seenEvents) add(id string, now time.Time) bool {
+	if id == "" {
+		return true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.list == nil {
+		e.list = make(map[string]time.Time)
+	}
+
+	for key, ts := range e.list {
+		if now.Sub(ts) > slackEventTTL {
+			delete(e.list, key)
+		}
+	}
+
+	if _, ok := e.list[id]; ok {
+		return false
+	}
+
+	e.list[id] = now
+
+	return true
+}
+
+// verify checks the request signature, the verifier also rejects requests
+// with a timestamp older than five minutes
+func (c *slackBackend) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, ok := daemonReadBody(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	sv, err := slack.NewSecretsVerifier(r.Header, c.signing_secret)
+	if err == nil {
+		sv.Write(body)
+		err = sv.Ensure()
+	}
+
+	if err != nil {
+		c.log.Warnf("slack request with a wrong signature - %s", err.Error())
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (c *slackBackend) handleEvents(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.verify(w, r)
+	if !ok {
+		return
+	}
+
+	payload, err := slackevents.ParseEvent(body, slackevents.OptionNoVerifyToken())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch payload.Type {
+	case slackevents.URLVerification:
+		var challenge slackevents.ChallengeResponse
+
+		json.Unmarshal(body, &challenge)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(challenge.Challenge))
+	case slackevents.CallbackEvent:
+		w.WriteHeader(http.StatusOK)
+
+		// slack retries the event when the answer is late, a retry of the
+		// received event is dropped
+		if cb, ok := payload.Data.(*slackevents.EventsAPICallbackEvent); ok && !c.seen.add(cb.EventID, time.Now()) {
+			c.log.Debugf("skipped the retry of the event %s", cb.EventID)
+			return
+		}
+
+		if e, ok := c.eventsAPIEvent(payload); ok {
+			c.events <- e
+		}
+	default:
+		c.log.Debugf("skipped: %v", payload.Type)
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (c *slackBackend) handleInteractive(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.verify(w, r)
+	if !ok {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var payload slack.InteractionCallback
+
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if e, ok := c.interactiveEvent(payload); ok {
+		c.events <- e
+	}
+}
+
+func (c *slackBackend) handleCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := c.verify(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	payload, err := slack.SlashCommandParse(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	c.events <- c.commandEvent(payload)
+}
@@ -0,0 +1,285 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChatBackend is implemented by every chat (Slack, Mattermost), the backend is
+// selected per config group with the chat key
+type ChatBackend interface {
+	// user groups
+	GetUserGroups() (map[string]string, error)
+	GetUserGroupMembers(group string) ([]string, error)
+	UpdateUserGroupMembers(group string, members []string) error
+
+	// users
+	GetUserByEmail(email string) (string, error)
+	GetUserEmail(user string) (string, error)
+	GetUserName(user string) (string, error)
+	// GetUserLocale is the language of the user, e.g. en-US
+	GetUserLocale(user string) (string, error)
+	// GetUserTimezone is the IANA timezone of the user, e.g. Europe/Berlin
+	GetUserTimezone(user string) (string, error)
+	Mention(user string) string
+
+	// Workspace is the name of the slack workspace or the mattermost server
+	Workspace() string
+
+	// messages, Run starts receiving the mentions, button clicks and slash
+	// commands and passes them to the handler one by one
+	Run(handler func(Event)) error
+	GetChannelName(channel string) (string, error)
+	GetPermalink(channel, ts string) (string, error)
+	PostAlert(channel, thread string, msg AlertMessage) (string, error)
+	UpdateAlert(channel, ts string, msg AlertMessage) error
+	PostMessage(channel, text string) error
+	PostEphemeral(channel, user, text string) error
+
+	// OpenAlertForm shows the paging form, the submitted form comes to the
+	// handler as a mention with the Form set
+	OpenAlertForm(trigger string, opts AlertFormOptions) error
+}
+
+// AlertForm is the paging form submitted from the chat, Data of the event is
+// the description
+type AlertForm struct {
+	Priority string
+	Schedule string
+	Summary  string
+	Teams    []string
+	Users    []string
+}
+
+// AlertFormOptions are the defaults of the paging form, without the channel
+// the form asks for it
+type AlertFormOptions struct {
+	Channel   string
+	Priority  string
+	Schedule  string
+	Schedules []string
+	Thread    string
+	TimeStamp string
+}
+
+// AlertMessage is a chat message with the alert state and the buttons, every
+// backend renders it in its own format
+type AlertMessage struct {
+	Actions []string
+	AlertID string
+	Color   string
+	// Confirm is the confirmation of the priority increase, empty disables it
+	Confirm  string
+	Fields   []AlertField
+	Priority string
+	Text     string
+}
+
+type AlertField struct {
+	Title string
+	Value string
+}
+
+func newChatBackend(name, group string, conf map[string]string, logger *log.Entry) (ChatBackend, error) {
+	switch name {
+	case "slack":
+		return newSlackBackend(group, conf, logger)
+	case "mattermost":
+		return newMattermostBackend(group, conf, logger)
+	default:
+		return nil, fmt.Errorf("unknown chat %#v", name)
+	}
+}
+
+// chatLogger tags the log of the config group, the sync works with all the
+// groups and the daemon has a schedule per app
+func (s *Schedules) chatLogger(item Schedule) *log.Entry {
+	chat_type := "usergroup"
+	if s.mode == "daemon" {
+		chat_type = "appname"
+	}
+
+	return log.WithFields(log.Fields{
+		chat_type:  item.group,
+		"chat":     item.chat,
+		"schedule": item.name,
+	})
+}
+
+func (s *Schedules) chatInit(item Schedule) (ChatBackend, error) {
+	if s.chats == nil {
+		s.chats = make(map[string]ChatBackend)
+	}
+
+	if chat, ok := s.chats[item.chat]; ok {
+		return chat, nil
+	}
+
+	logger := s.chatLogger(item)
+	logger.Infof("init %s client", item.chat)
+
+	chat, err := newChatBackend(item.chat, item.group, item.chatConf, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s.chats[item.chat] = chat
+
+	return chat, nil
+}
+
+// chat returns the backend of a daemon app, every app has exactly one schedule
+// and the backend is initialized when the app connects
+func (s *Schedules) chat() ChatBackend {
+	return s.chats[s.list[0].chat]
+}
+
+func (s *Schedules) chatFindUsers() error {
+	if s.users == nil {
+		s.users = make(map[string]string)
+	}
+
+	for _, item := range s.list {
+		if len(item.finalDuty) < 1 {
+			continue
+		}
+
+		chat, err := s.chatInit(item)
+		if err != nil {
+			return err
+		}
+
+		for idx, duty := range item.finalDuty {
+			user, err := chat.GetUserByEmail(duty.User)
+			if err != nil {
+				s.log.WithField("group", item.group).Warnf("can't find user %#v", duty.User)
+
+				user = "" // the user will be removed from duty
+			}
+
+			if user != "" {
+				s.users[user] = duty.User
+			}
+
+			item.finalDuty[idx].User = user
+		}
+	}
+
+	return nil
+}
+
+func (s *Schedules) chatGetUserGroups() error {
+	if s.groups == nil {
+		s.groups = make(map[string]map[string]string)
+	}
+
+	for idx, item := range s.list {
+		if len(item.duty) < 1 {
+			continue
+		}
+
+		chat, err := s.chatInit(item)
+		if err != nil {
+			return err
+		}
+
+		// the user groups are listed once per process, a continuous sync only
+		// lists them again when a configured handle is missing
+		if _, ok := s.groups[item.chat][item.group]; !ok {
+			groups, err := chat.GetUserGroups()
+			if err != nil {
+				return err
+			}
+
+			s.groups[item.chat] = groups
+
+			s.log.Debugf("%s user groups: %#v", item.chat, groups)
+		}
+
+		group, ok := s.groups[item.chat][item.group]
+		if !ok {
+			s.log.WithField("group", item.group).Errorf("can't find group id")
+		}
+
+		s.list[idx].groupID = group
+	}
+
+	return nil
+}
+
+// chatUserGroupMembers accepts both the user group ID and its handle
+func (s *Schedules) chatUserGroupMembers(group string) ([]string, error) {
+	item := s.list[0]
+
+	if s.groups == nil {
+		s.groups = make(map[string]map[string]string)
+	}
+
+	if s.groups[item.chat] == nil {
+		groups, err := s.chat().GetUserGroups()
+		if err != nil {
+			return nil, err
+		}
+
+		s.groups[item.chat] = groups
+	}
+
+	if id, ok := s.groups[item.chat][group]; ok {
+		group = id
+	}
+
+	return s.chat().GetUserGroupMembers(group)
+}
+
+func (s *Schedules) chatUserMember(item Schedule, uid string) UserGroupMember {
+	if email, ok := s.users[uid]; ok {
+		return UserGroupMember{ID: uid, Email: email}
+	}
+
+	chat, err := s.chatInit(item)
+	if err != nil {
+		return UserGroupMember{ID: uid}
+	}
+
+	email, err := chat.GetUserEmail(uid)
+	if err != nil {
+		s.log.WithField("group", item.group).Warnf("can't get user info %#v", uid)
+
+		return UserGroupMember{ID: uid}
+	}
+
+	s.users[uid] = email
+
+	return UserGroupMember{ID: uid, Email: email}
+}
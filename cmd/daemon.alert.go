@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// AlertTemplateData is the context of the alert message, description and
+// entity templates (_opsgenie.alert.*)
+type AlertTemplateData struct {
+	App       string
+	Channel   AlertTemplateChannel
+	Permalink string
+	Priority  string
+	Reporter  AlertTemplateUser
+	Schedule  string
+	Summary   string
+	Tags      []string
+	Text      string
+	Workspace string
+}
+
+type AlertTemplateChannel struct {
+	ID   string
+	Name string
+}
+
+type AlertTemplateUser struct {
+	ID    string
+	Email string
+	Name  string
+}
+
+// alertTemplates are the templates of the alert fields, every one of them
+// has to be set, the defaults are in initConfig
+var alertTemplates = []string{"message", "description", "entity"}
+
+func parseAlertTemplates(item string, text map[string]string) (*template.Template, error) {
+	tmpl := template.New(item).Option("missingkey=error")
+
+	for _, name := range alertTemplates {
+		if _, err := tmpl.New(name).Parse(text[name]); err != nil {
+			return nil, fmt.Errorf("%s: can't parse the alert %s template - %s", item, name, err)
+		}
+	}
+
+	// an empty context catches the unknown fields at startup
+	for _, name := range alertTemplates {
+		if err := tmpl.ExecuteTemplate(&bytes.Buffer{}, name, AlertTemplateData{}); err != nil {
+			return nil, fmt.Errorf("%s: bad alert %s template - %s", item, name, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// alertTemplateData collects what's known about the mention, the chat errors
+// only leave the fields empty
+func (s *Schedules) alertTemplateData(e Event, link, priority, summary string, tags []string) AlertTemplateData {
+	data := AlertTemplateData{
+		App:       s.list[0].group,
+		Channel:   AlertTemplateChannel{ID: e.ChannelID, Name: e.ChannelID},
+		Permalink: link,
+		Priority:  priority,
+		Reporter:  AlertTemplateUser{ID: e.UserID, Name: e.UserID},
+		Schedule:  s.list[0].name,
+		Summary:   summary,
+		Tags:      tags,
+		Text:      e.Data,
+		Workspace: s.chat().Workspace(),
+	}
+
+	if name, err := s.chat().GetChannelName(e.ChannelID); err != nil {
+		s.log.Warnf("can't get the channel name - %s", err.Error())
+	} else {
+		data.Channel.Name = name
+	}
+
+	if name, err := s.chat().GetUserName(e.UserID); err != nil {
+		s.log.Warnf("can't get the user name - %s", err.Error())
+	} else {
+		data.Reporter.Name = name
+	}
+
+	if email, err := s.chat().GetUserEmail(e.UserID); err != nil {
+		s.log.Warnf("can't get the user email - %s", err.Error())
+	} else {
+		data.Reporter.Email = email
+	}
+
+	return data
+}
+
+// alertRequest renders the alert fields from the templates of the app group
+func (s *Schedules) alertRequest(data AlertTemplateData) (AlertRequest, error) {
+	fields := make(map[string]string)
+
+	for _, name := range alertTemplates {
+		var buf bytes.Buffer
+
+		if err := s.list[0].alertTemplate.ExecuteTemplate(&buf, name, data); err != nil {
+			return AlertRequest{}, err
+		}
+
+		fields[name] = strings.TrimSpace(buf.String())
+	}
+
+	return AlertRequest{
+		Description: fields["description"],
+		Details: map[string]string{
+			"app":            data.App,
+			"channel":        data.Channel.Name,
+			"permalink":      data.Permalink,
+			"reporter":       data.Reporter.Name,
+			"reporter_email": data.Reporter.Email,
+			"workspace":      data.Workspace,
+		},
+		Entity:   fields["entity"],
+		Message:  fields["message"],
+		Priority: data.Priority,
+		Source:   fmt.Sprintf("%s/%s", pkg, s.list[0].chat),
+		Tags:     data.Tags,
+	}, nil
+}
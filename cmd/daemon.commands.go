@@ -0,0 +1,391 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historySize is how many overrides the history command shows
+const historySize = 10
+
+// historyDays is how far back the history command looks for the overrides
+const historyDays = 30
+
+// shiftTimeFormat is the time of the shifts in the messages
+const shiftTimeFormat = "Mon 02 Jan 15:04 MST"
+
+func shiftTime(t time.Time) string {
+	return t.UTC().Format(shiftTimeFormat)
+}
+
+// mentionEmail is the chat mention of the on-call user, the email is shown
+// when the user isn't found in the chat
+func (s *Schedules) mentionEmail(email string) string {
+	for uid, item := range s.users {
+		if strings.EqualFold(item, email) {
+			return s.chat().Mention(uid)
+		}
+	}
+
+	uid, err := s.chat().GetUserByEmail(email)
+	if err != nil || uid == "" {
+		return email
+	}
+
+	if s.users != nil {
+		s.users[uid] = email
+	}
+
+	return s.chat().Mention(uid)
+}
+
+func (s *Schedules) messageShifts(shifts []Shift) []MessageShift {
+	list := []MessageShift{}
+
+	for _, shift := range shifts {
+		list = append(list, MessageShift{
+			User:  s.mentionEmail(shift.User),
+			Start: shiftTime(shift.Start),
+			End:   shiftTime(shift.End),
+		})
+	}
+
+	return list
+}
+
+// SlashCommandNext shows who takes the duty and when, the handover is the end
+// of the earliest current shift
+func (s *Schedules) SlashCommandNext(msg *MessageData) error {
+	now := time.Now()
+
+	shifts, err := s.oncallShifts(now, now.AddDate(0, 0, 14))
+	if err != nil {
+		return err
+	}
+
+	handover := time.Time{}
+	for _, shift := range shifts {
+		if !shift.Start.After(now) && (handover.IsZero() || shift.End.Before(handover)) {
+			handover = shift.End
+		}
+	}
+
+	if handover.IsZero() {
+		handover = now
+	}
+
+	for _, shift := range shifts {
+		if !shift.Start.Before(handover) {
+			msg.Next = s.mentionEmail(shift.User)
+			msg.NextShift = shiftTime(shift.Start)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("there are no shifts in the next two weeks")
+}
+
+// SlashCommandList shows the rotation for the week
+func (s *Schedules) SlashCommandList(msg *MessageData) error {
+	now := time.Now()
+
+	shifts, err := s.oncallShifts(now, now.AddDate(0, 0, 7))
+	if err != nil {
+		return err
+	}
+
+	msg.Shifts = s.messageShifts(shifts)
+
+	return nil
+}
+
+// SlashCommandHistory shows the overrides started in the last days, the
+// latest first
+func (s *Schedules) SlashCommandHistory(msg *MessageData) error {
+	now := time.Now()
+
+	overrides, err := s.oncallOverrideHistory(now.AddDate(0, 0, -historyDays), now)
+	if err != nil {
+		return err
+	}
+
+	if len(overrides) > historySize {
+		overrides = overrides[:historySize]
+	}
+
+	msg.Shifts = s.messageShifts(overrides)
+
+	return nil
+}
+
+// SlashCommandRelease deletes the active override of the caller, the channel
+// is told the duty went back
+func (s *Schedules) SlashCommandRelease(e Event, msg *MessageData) error {
+	email, err := s.chat().GetUserEmail(e.UserID)
+	if err != nil {
+		return err
+	}
+
+	overrides, err := s.oncallOverrides()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, override := range overrides {
+		if !strings.EqualFold(override.User, email) || override.Start.After(now) || !override.End.After(now) {
+			continue
+		}
+
+		if err := s.oncallDeleteOverride(override.ID); err != nil {
+			return err
+		}
+
+		msg.NextShift = shiftTime(override.End)
+		msg.Shifts = s.messageShifts([]Shift{override})
+
+		return s.chat().PostMessage(e.ChannelID, s.message("command.duty_was_released", *msg))
+	}
+
+	return fmt.Errorf("you have no active override")
+}
+
+// overrideRequest is carried by the buttons of the take and swap
+// confirmations, so the answer doesn't depend on the daemon state
+type overrideRequest struct {
+	Caller string
+	Target string
+	Start  time.Time
+	End    time.Time
+}
+
+func (r overrideRequest) String() string {
+	return fmt.Sprintf("%s:%s:%d:%d", r.Caller, r.Target, r.Start.Unix(), r.End.Unix())
+}
+
+// clamp starts the override from now when its start has passed, the
+// override can't be created in the past
+func (r overrideRequest) clamp(now time.Time) overrideRequest {
+	if r.Start.Before(now) {
+		r.Start = now
+	}
+
+	return r
+}
+
+func parseOverrideRequest(text string) (overrideRequest, error) {
+	data := strings.Split(text, ":")
+	if len(data) != 4 {
+		return overrideRequest{}, fmt.Errorf("bad override request %#v", text)
+	}
+
+	start, err := strconv.ParseInt(data[2], 10, 64)
+	if err != nil {
+		return overrideRequest{}, err
+	}
+
+	end, err := strconv.ParseInt(data[3], 10, 64)
+	if err != nil {
+		return overrideRequest{}, err
+	}
+
+	return overrideRequest{Caller: data[0], Target: data[1], Start: time.Unix(start, 0), End: time.Unix(end, 0)}, nil
+}
+
+// overrideAction is a button of the take or swap confirmation
+func overrideAction(action string) bool {
+	return strings.HasPrefix(action, "take_") || strings.HasPrefix(action, "swap_")
+}
+
+// userTimezone is the timezone of the chat user, UTC when it's unknown
+func (s *Schedules) userTimezone(user string) *time.Location {
+	name, err := s.chat().GetUserTimezone(user)
+	if err != nil {
+		s.log.Warnf("can't get the user timezone - %s", err.Error())
+
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		s.log.Warnf("unknown timezone %#v", name)
+
+		return time.UTC
+	}
+
+	return loc
+}
+
+// overrideData fills the window of the request in UTC and in the timezone of
+// the caller
+func (s *Schedules) overrideData(msg *MessageData, req overrideRequest, loc *time.Location) {
+	msg.Caller = s.chat().Mention(req.Caller)
+	msg.Duration = overrideDuration(req.End.Sub(req.Start))
+	msg.End = shiftTime(req.End)
+	msg.LocalEnd = req.End.In(loc).Format(shiftTimeFormat)
+	msg.LocalStart = req.Start.In(loc).Format(shiftTimeFormat)
+	msg.NextShift = msg.End
+	msg.Start = shiftTime(req.Start)
+	msg.User = s.chat().Mention(req.Target)
+}
+
+// overrideDuration is the duration in hours and minutes, e.g. 1h30m
+func overrideDuration(d time.Duration) string {
+	minutes := int(d.Round(time.Minute).Minutes())
+
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%dh", minutes/60)
+	default:
+		return fmt.Sprintf("%dh%dm", minutes/60, minutes%60)
+	}
+}
+
+// chatMentionID is the user of the escaped mention <@U123|name>
+var chatMentionID = regexp.MustCompile(`^<@([A-Za-z0-9]+)(\|[^>]*)?>$`)
+
+// SlashCommandSwap asks the mentioned user to take the duty for the time, the
+// override is created when the user accepts
+func (s *Schedules) SlashCommandSwap(e Event, data []string, msg *MessageData) error {
+	if len(data) < 3 {
+		return fmt.Errorf("to use the command, mention the user and enter the time, e.g. swap @user 2h")
+	}
+
+	match := chatMentionID.FindStringSubmatch(data[1])
+	if match == nil {
+		return fmt.Errorf("can't find the user %s, the mentions of the slash command have to be escaped", data[1])
+	}
+
+	if match[1] == e.UserID {
+		return fmt.Errorf("use take to get the duty yourself")
+	}
+
+	loc := s.userTimezone(e.UserID)
+
+	start, end, err := parseWindow(data[2:], time.Now().In(loc))
+	if err != nil {
+		return err
+	}
+
+	req := overrideRequest{Caller: e.UserID, Target: match[1], Start: start, End: end}.clamp(time.Now())
+	s.overrideData(msg, req, loc)
+
+	_, err = s.chat().PostAlert(e.ChannelID, "", AlertMessage{
+		Actions: []string{"swap_accept", "swap_decline"},
+		AlertID: req.String(),
+		Text:    s.message("command.swap_request", *msg),
+	})
+
+	return err
+}
+
+// OverrideAnswer creates the override when the user confirms the take or
+// accepts the swap, the late answers start the override from now
+func (s *Schedules) OverrideAnswer(e Event) {
+	req, err := parseOverrideRequest(e.AlertID)
+	if err != nil {
+		s.log.Error(err)
+
+		return
+	}
+
+	// the message shows the window the override is created with
+	msg := s.messageData(e)
+	s.overrideData(&msg, req.clamp(time.Now()), s.userTimezone(req.Caller))
+
+	if e.UserID != req.Target {
+		if err := s.chat().PostEphemeral(e.ChannelID, e.UserID, s.userMessage(e.UserID, "command.not_yours", msg)); err != nil {
+			s.log.Error(err)
+		}
+
+		return
+	}
+
+	update := AlertMessage{Actions: []string{}, AlertID: e.AlertID}
+
+	switch {
+	case e.Action == "swap_decline":
+		update.Text = s.message("command.swap_declined", msg)
+	case e.Action == "take_cancel":
+		update.Text = s.message("command.take_cancelled", msg)
+	case !time.Now().Before(req.End):
+		update.Text = s.message("command.override_expired", msg)
+	default:
+		if !s.authorize(e, "take") {
+			return
+		}
+
+		if err := s.requestOverride(req); err != nil {
+			s.log.Errorf("can't create the override - %s", err.Error())
+
+			if err := s.chat().PostEphemeral(e.ChannelID, e.UserID, fmt.Sprintf(":bangbang: `%s`", err)); err != nil {
+				s.log.Error(err)
+			}
+
+			return
+		}
+
+		update.Color = "good"
+		update.Text = s.message("command.duty_was_taken", msg)
+
+		if e.Action == "swap_accept" {
+			update.Text = s.message("command.swap_accepted", msg)
+		}
+	}
+
+	if err := s.chat().UpdateAlert(e.ChannelID, e.TimeStamp, update); err != nil {
+		s.log.Error(err)
+	}
+}
+
+func (s *Schedules) requestOverride(req overrideRequest) error {
+	email, err := s.chat().GetUserEmail(req.Target)
+	if err != nil {
+		return err
+	}
+
+	if email == "" {
+		return fmt.Errorf("the email of the user is empty")
+	}
+
+	req = req.clamp(time.Now())
+
+	return s.oncallOverride(email, req.Start, req.End)
+}
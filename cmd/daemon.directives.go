@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	directivePriority = regexp.MustCompile(`^P[1-5]$`)
+	directiveTag      = regexp.MustCompile(`^(?:#|tag:)([\w.-]+)$`)
+	directiveChannel  = regexp.MustCompile(`^<#\w+\|([\w.-]+)>$`) // slack links #name to a channel when it exists
+	directiveTeam     = regexp.MustCompile(`^team:([\w.-]+)$`)
+)
+
+// AlertDirectives are the priority, tags and teams written in the mention
+// text, e.g. "@opsgin P2 #db team:sre the replica is lagging"
+type AlertDirectives struct {
+	Priority string
+	Tags     []string
+	Teams    []string
+}
+
+func parseAlertDirectives(text string) AlertDirectives {
+	d := AlertDirectives{Tags: []string{}, Teams: []string{}}
+
+	for _, word := range strings.Fields(text) {
+		switch {
+		case directivePriority.MatchString(word):
+			d.Priority = word
+		case directiveTag.MatchString(word):
+			d.Tags = appendUnique(d.Tags, directiveTag.FindStringSubmatch(word)[1])
+		case directiveChannel.MatchString(word):
+			d.Tags = appendUnique(d.Tags, directiveChannel.FindStringSubmatch(word)[1])
+		case directiveTeam.MatchString(word):
+			d.Teams = appendUnique(d.Teams, directiveTeam.FindStringSubmatch(word)[1])
+		}
+	}
+
+	return d
+}
+
+func (d AlertDirectives) Responders() []Responder {
+	responders := []Responder{}
+
+	for _, team := range d.Teams {
+		responders = append(responders, Responder{Name: team, Type: "team"})
+	}
+
+	return responders
+}
+
+func appendUnique(list []string, item string) []string {
+	if slices.Contains(list, item) {
+		return list
+	}
+
+	return append(list, item)
+}
+
+// directiveFields shows the tags and teams from the mention in the alert message
+func (s *Schedules) directiveFields(tags, teams []string) []AlertField {
+	fields := []AlertField{}
+
+	if len(tags) > 0 {
+		fields = append(fields, AlertField{Title: s.message("fields.tags", MessageData{}), Value: strings.Join(tags, ", ")})
+	}
+
+	if len(teams) > 0 {
+		fields = append(fields, AlertField{Title: s.message("fields.teams", MessageData{}), Value: strings.Join(teams, ", ")})
+	}
+
+	return fields
+}
+
+// storedDirectiveFields is directiveFields of an alert from the store
+func (s *Schedules) storedDirectiveFields(alertID string) []AlertField {
+	state, err := s.store.Get(alertID)
+	if err != nil || state == nil {
+		return []AlertField{}
+	}
+
+	return s.directiveFields(state.Tags, state.Teams)
+}
@@ -0,0 +1,685 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// schedulerRefresh is how often the countdown in the alert message is updated
+const schedulerRefresh = 5 * time.Second
+
+func (s *Schedules) chatClients() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scheduler := newScheduler()
+	go scheduler.Run(ctx)
+
+	store, err := newAlertStore(viper.GetString("_daemon.store"))
+	if err != nil {
+		return fmt.Errorf("can't open the alert store - %s", err)
+	}
+	defer store.Close()
+
+	apps := make(map[string]*Schedules)
+
+	for _, item := range s.list {
+		schedule := &Schedules{
+			channels:  &channelNames{names: make(map[string]string)},
+			list:      []Schedule{item},
+			log:       s.chatLogger(item),
+			mode:      s.mode,
+			mu:        &sync.Mutex{},
+			scheduler: scheduler,
+			store:     store,
+		}
+
+		if err := schedule.chatConnect(); err != nil {
+			return err
+		}
+
+		apps[item.group] = schedule
+	}
+
+	if viper.GetString("_opsgenie.webhook.secret") != "" {
+		daemonHandle("/webhooks/opsgenie", webhookOpsgenie(store, apps))
+	}
+
+	server, err := daemonServe()
+	if err != nil {
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+
+	log.WithFields(log.Fields{
+		"signal": sig.String(),
+		"code":   fmt.Sprintf("%d", sig),
+	}).Info("Signal notify")
+
+	if server != nil {
+		server.Close()
+	}
+
+	return nil
+}
+
+func (s *Schedules) chatConnect() error {
+	chat, err := s.chatInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	// the provider is shared with the routed schedules
+	if _, err := s.oncallInit(s.list[0]); err != nil {
+		return err
+	}
+
+	if err := chat.Run(s.chatHandleEvent); err != nil {
+		return err
+	}
+
+	return s.storeResume()
+}
+
+func (s *Schedules) chatHandleEvent(e Event) {
+	// the form has to be opened in a few seconds after the shortcut, it
+	// doesn't wait for the alert being created by another event
+	if e.Type == "shortcut" {
+		s.AlertFormOpen(e)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// most of the replies aren't in the alert threads, the on-duty isn't
+	// loaded for them
+	if e.Type == "reply" {
+		s.ThreadReply(e)
+
+		return
+	}
+
+	if e.Type == "reaction" {
+		var ok bool
+
+		if e, ok = s.chatReaction(e); !ok {
+			return
+		}
+	}
+
+	r := s.routed(s.chatRoute(e))
+
+	r.log.Debugf("getting schedule - %#v", r.list[0].name)
+	if err := r.oncallGetSchedules(r.list[0].name); err != nil {
+		r.log.Errorf("can't load schedule - %s", err.Error())
+
+		return
+	}
+
+	r.log.Debug("getting chat users")
+	if err := r.chatFindUsers(); err != nil {
+		r.log.Errorf("can't load chat users - %s", err.Error())
+
+		return
+	}
+
+	// the webhook brings the on-duty of the alert
+	if e.OnDuty == nil {
+		e.OnDuty = r.onDuty()
+	}
+
+	switch e.Type {
+	case "interactive":
+		if overrideAction(e.Action) {
+			r.OverrideAnswer(e)
+		} else if r.authorize(e, permissionActions[e.Action]) {
+			r.Interactive(e)
+		}
+	case "mention":
+		r.EventsApi(e)
+	case "command":
+		r.SlashCommand(e)
+	case "webhook":
+		r.Webhook(e)
+	}
+}
+
+// chatReaction turns a reaction on the alert message into the same event as
+// the button of the action
+func (s *Schedules) chatReaction(e Event) (Event, bool) {
+	action, ok := s.list[0].reactions[e.Data]
+	if !ok {
+		return e, false
+	}
+
+	state, err := s.store.Message(s.list[0].group, e.ChannelID, e.TimeStamp)
+	if err != nil {
+		s.log.Errorf("can't get the stored alert - %s", err.Error())
+
+		return e, false
+	}
+
+	if state == nil {
+		return e, false
+	}
+
+	e.Type = "interactive"
+	e.Action = action
+	e.AlertID = state.AlertID
+	e.AlertPriority = state.Priority
+
+	return e, true
+}
+
+// alertFields shows the priority, the on-duty and the countdown to the next
+// escalation step when it's known
+func (s *Schedules) alertFields(priority string, duty []OnCall, next *EscalationStep, remaining int) []AlertField {
+	data := MessageData{
+		Priority: priority,
+		Schedule: s.list[0].name,
+	}
+
+	s.onDutyData(&data, duty)
+
+	alertField := []AlertField{
+		{Title: s.message("fields.priority", data), Value: priority},
+		{Title: s.message("fields.on_duty", data), Value: s.message("on_duty.list", data)},
+	}
+
+	if next != nil && remaining > 0 {
+		data.NextPriority = next.Priority
+		data.Remaining = fmt.Sprintf("%02d:%02d", remaining/60, remaining%60)
+
+		alertField = append(alertField, AlertField{Title: s.message("fields.priority_next", data)})
+	}
+
+	return alertField
+}
+
+// alertActions hides the increase priority button once the alert is P1
+func alertActions(priority string) []string {
+	if priority == "P1" {
+		return []string{"alert_acknowledge", "alert_close"}
+	}
+
+	return []string{"alert_increase_priority", "alert_acknowledge", "alert_close"}
+}
+
+func alertColor(priority string) string {
+	if priority == "P1" {
+		return "danger"
+	}
+
+	return "warning"
+}
+
+// alertPriority is the priority from the mention, the route or the default one
+func (s *Schedules) alertPriority(d AlertDirectives) string {
+	if d.Priority != "" {
+		return d.Priority
+	}
+
+	if s.list[0].priority != "" {
+		return s.list[0].priority
+	}
+
+	return viper.GetString("_opsgenie.priority")
+}
+
+// AlertFormOpen shows the paging form with the schedule and priority of the
+// channel route selected
+func (s *Schedules) AlertFormOpen(e Event) {
+	item := s.chatRoute(Event{ChannelID: e.ChannelID})
+
+	priority := item.priority
+	if priority == "" {
+		priority = viper.GetString("_opsgenie.priority")
+	}
+
+	if err := s.chat().OpenAlertForm(e.Data, AlertFormOptions{
+		Channel:   e.ChannelID,
+		Priority:  priority,
+		Schedule:  item.name,
+		Schedules: s.routeSchedules(),
+		Thread:    e.ThreadTimeStamp,
+		TimeStamp: e.TimeStamp,
+	}); err != nil {
+		s.log.Errorf("can't open the alert form - %s", err.Error())
+	}
+}
+
+func (s *Schedules) EventsApi(e Event) {
+	var (
+		escalation = s.list[0].escalation
+		directives = parseAlertDirectives(e.Data)
+		responders = []Responder{}
+		summary    string
+	)
+
+	// the form has the same fields as the mention directives
+	if e.Form != nil {
+		directives = AlertDirectives{Priority: e.Form.Priority, Tags: []string{}, Teams: e.Form.Teams}
+		summary = e.Form.Summary
+
+		for _, user := range e.Form.Users {
+			email, err := s.chat().GetUserEmail(user)
+			if err != nil || email == "" {
+				s.log.Warnf("can't get the email of %#v", user)
+
+				continue
+			}
+
+			responders = append(responders, Responder{Name: email, Type: "user"})
+		}
+	}
+
+	var (
+		priority     = s.alertPriority(directives)
+		alertFields  = s.alertFields(priority, e.OnDuty, nil, 0)
+		chatResponse = "alert_create.success"
+		actions      = alertActions(priority)
+		link         string
+		step         = escalationNext(escalation, 0, priority)
+	)
+
+	if step < len(escalation) {
+		alertFields = s.alertFields(priority, e.OnDuty, &escalation[step], int(escalation[step].After.Seconds()))
+	}
+
+	alertFields = append(alertFields, s.directiveFields(directives.Tags, directives.Teams)...)
+
+	ts := e.TimeStamp
+	if e.ThreadTimeStamp != "" {
+		ts = e.ThreadTimeStamp
+	}
+
+	// the form opened from the shortcut posts the alert to the channel
+	if e.TimeStamp != "" {
+		s.log.Debug("getting permalink")
+		l, err := s.chat().GetPermalink(e.ChannelID, e.TimeStamp)
+		if err != nil {
+			s.log.Errorf("can't get permalink - %s", err.Error())
+
+			return
+		}
+
+		link = l
+
+		// the thread was already paged, the mention is added to its alert
+		if state, err := s.store.Thread(s.list[0].group, e.ChannelID, ts); err != nil {
+			s.log.Errorf("can't get the stored alert - %s", err.Error())
+		} else if state != nil && !s.alertClosed(*state) {
+			s.AlertDuplicate(e, *state, link)
+
+			return
+		}
+	}
+
+	alertID := ""
+
+	s.log.Debug("adding on-call alert")
+	req, err := s.alertRequest(s.alertTemplateData(e, link, priority, summary, directives.Tags))
+	if err == nil {
+		if ts != "" {
+			req.Alias = alertAlias(e.ChannelID, ts)
+		}
+
+		alertID, err = s.oncallAddAlert(req, append(directives.Responders(), responders...))
+	}
+
+	if err != nil {
+		actions = []string{}
+		alertFields = []AlertField{}
+		chatResponse = "alert_create.failure"
+
+		s.log.Errorf("can't create alert - %s", err.Error())
+	}
+
+	s.log.Debugf("posting the alert message to %s", e.ChannelID)
+	data := s.messageData(e)
+	data.AlertID = alertID
+	data.Priority = priority
+
+	respTS, err := s.chat().PostAlert(e.ChannelID, ts, AlertMessage{
+		Actions:  actions,
+		AlertID:  alertID,
+		Color:    alertColor(priority),
+		Confirm:  s.alertConfirm(),
+		Fields:   alertFields,
+		Priority: priority,
+		Text:     s.message(chatResponse, data),
+	})
+	if err != nil {
+		s.log.Error(err, respTS)
+	}
+
+	if alertID == "" || err != nil {
+		return
+	}
+
+	if ts == "" {
+		ts = respTS
+	}
+
+	state := AlertState{
+		AlertID:   alertID,
+		App:       s.list[0].group,
+		ChannelID: e.ChannelID,
+		Created:   time.Now(),
+		Creator:   e.UserID,
+		MessageTS: respTS,
+		OnDuty:    e.OnDuty,
+		Priority:  priority,
+		Schedule:  s.list[0].name,
+		Step:      step,
+		Tags:      directives.Tags,
+		Teams:     directives.Teams,
+		ThreadTS:  ts,
+	}
+
+	if step < len(escalation) {
+		state.Deadline = state.Created.Add(escalation[step].After)
+	}
+
+	if err := s.store.Put(state); err != nil {
+		s.log.Errorf("can't store the alert - %s", err.Error())
+	}
+
+	if step < len(escalation) {
+		s.AlertPriorityAutoIncrease(state)
+	}
+}
+
+// AlertPriorityAutoIncrease hands the next escalation step of the alert to the
+// scheduler, the message is refreshed every few seconds until the step is
+// applied and then the following step is scheduled
+func (s *Schedules) AlertPriorityAutoIncrease(state AlertState) {
+	escalation := s.list[0].escalation
+	if state.Step >= len(escalation) {
+		return
+	}
+
+	step := escalation[state.Step]
+
+	update := func(msg AlertMessage) {
+		if err := s.chat().UpdateAlert(state.ChannelID, state.MessageTS, msg); err != nil {
+			s.log.Error(err)
+		}
+	}
+
+	data := func() MessageData {
+		data := MessageData{
+			AlertID:  state.AlertID,
+			Caller:   s.chat().Mention(state.Creator),
+			Priority: state.Priority,
+			Schedule: s.list[0].name,
+		}
+
+		s.onDutyData(&data, state.OnDuty)
+
+		return data
+	}
+
+	s.scheduler.Schedule(
+		state.AlertID,
+		state.Deadline,
+		schedulerRefresh,
+		s.mu,
+		func(remaining time.Duration) {
+			update(AlertMessage{
+				Actions:  alertActions(state.Priority),
+				AlertID:  state.AlertID,
+				Color:    alertColor(state.Priority),
+				Confirm:  s.alertConfirm(),
+				Fields:   append(s.alertFields(state.Priority, state.OnDuty, &step, int(remaining.Round(time.Second).Seconds())), s.directiveFields(state.Tags, state.Teams)...),
+				Priority: state.Priority,
+				Text:     s.message("alert_create.success", data()),
+			})
+		},
+		func() {
+			chatResponse := "alert_create.success"
+
+			if err := s.oncallIncreaseAlertPriority(state.AlertID, step.Priority); err != nil {
+				chatResponse = "alert_increase_priority.failure"
+
+				s.log.Errorf("can't increase alert priority - %s", err.Error())
+			} else {
+				state.Priority = step.Priority
+			}
+
+			if err := s.oncallAddResponders(state.AlertID, step.Responders); err != nil {
+				s.log.Errorf("can't add alert responders - %s", err.Error())
+			}
+
+			state.Step = escalationNext(escalation, state.Step+1, state.Priority)
+			state.Deadline = time.Time{}
+
+			var (
+				next      *EscalationStep
+				remaining int
+			)
+
+			if state.Step < len(escalation) {
+				next = &escalation[state.Step]
+				state.Deadline = state.Created.Add(next.After)
+				remaining = int(time.Until(state.Deadline).Round(time.Second).Seconds())
+			}
+
+			if err := s.store.Put(state); err != nil {
+				s.log.Errorf("can't store the alert - %s", err.Error())
+			}
+
+			update(AlertMessage{
+				Actions:  alertActions(state.Priority),
+				AlertID:  state.AlertID,
+				Color:    alertColor(state.Priority),
+				Confirm:  s.alertConfirm(),
+				Fields:   append(s.alertFields(state.Priority, state.OnDuty, next, remaining), s.directiveFields(state.Tags, state.Teams)...),
+				Priority: state.Priority,
+				Text:     s.message(chatResponse, data()),
+			})
+
+			if next != nil {
+				s.AlertPriorityAutoIncrease(state)
+			}
+		},
+	)
+}
+
+func (s *Schedules) Interactive(e Event) {
+	var (
+		alertActions []string
+		alertColor   string
+		alertFields  = append(s.alertFields(e.AlertPriority, e.OnDuty, nil, 0), s.storedDirectiveFields(e.AlertID)...)
+		chatResponse string
+	)
+
+	// the escalation keeps running when the provider call fails
+	switch e.Action {
+	case "alert_close":
+		alertColor = "good"
+		chatResponse = "alert_close.success"
+
+		if err := s.oncallCloseAlert(e.AlertID, s.alertUpdate(e, "Closed")); err != nil {
+			chatResponse = "alert_close.failure"
+
+			s.log.Errorf("can't close alert - %s", err.Error())
+		} else {
+			alertActions = []string{}
+
+			s.scheduler.Cancel(e.AlertID)
+			s.storeDelete(e.AlertID)
+		}
+	case "alert_acknowledge":
+		alertColor = "#039be5"
+		chatResponse = "alert_acknowledged.success"
+
+		if err := s.oncallAckAlert(e.AlertID, s.alertUpdate(e, "Acknowledged")); err != nil {
+			chatResponse = "alert_acknowledged.failure"
+
+			s.log.Errorf("can't ack alert - %s", err.Error())
+		} else {
+			alertActions = []string{"alert_close"}
+
+			s.scheduler.Cancel(e.AlertID)
+			s.storeUpdate(e, func(state *AlertState) {
+				state.Deadline = time.Time{}
+			})
+		}
+	case "alert_increase_priority":
+		e.AlertPriority = "P1"
+
+		alertFields = append(s.alertFields(e.AlertPriority, e.OnDuty, nil, 0), s.storedDirectiveFields(e.AlertID)...)
+		alertColor = "danger"
+		chatResponse = "alert_increase_priority.success"
+
+		if err := s.oncallIncreaseAlertPriority(e.AlertID, e.AlertPriority); err != nil {
+			chatResponse = "alert_increase_priority.failure"
+
+			s.log.Errorf("can't close alert - %s", err.Error())
+		} else {
+			alertActions = []string{"alert_acknowledge", "alert_close"}
+
+			s.scheduler.Cancel(e.AlertID)
+			s.storeUpdate(e, func(state *AlertState) {
+				state.Deadline = time.Time{}
+				state.Priority = e.AlertPriority
+			})
+		}
+	}
+
+	if err := s.chat().UpdateAlert(e.ChannelID, e.TimeStamp, AlertMessage{
+		Actions:  alertActions,
+		AlertID:  e.AlertID,
+		Color:    alertColor,
+		Confirm:  s.alertConfirm(),
+		Fields:   alertFields,
+		Priority: e.AlertPriority,
+		Text:     s.message(chatResponse, s.messageData(e)),
+	}); err != nil {
+		s.log.Error(err)
+	}
+}
+
+func (s *Schedules) SlashCommand(e Event) {
+	data := strings.Fields(e.Data)
+	response := ""
+
+	for len(data) < 2 {
+		data = append(data, "")
+	}
+
+	msg := s.messageData(e)
+	msg.Duration = data[1]
+
+	var err error
+
+	switch data[0] {
+	case "take":
+		if !s.authorize(e, "take") {
+			return
+		}
+
+		response, err = "command.take_requested", s.SlashCommandTake(e, data, &msg)
+	case "release":
+		if !s.authorize(e, "release") {
+			return
+		}
+
+		response, err = "command.released", s.SlashCommandRelease(e, &msg)
+	case "swap":
+		if !s.authorize(e, "take") {
+			return
+		}
+
+		response, err = "command.swap_requested", s.SlashCommandSwap(e, data, &msg)
+	case "next":
+		response, err = "command.next", s.SlashCommandNext(&msg)
+	case "list":
+		response, err = "command.list", s.SlashCommandList(&msg)
+	case "history":
+		response, err = "command.history", s.SlashCommandHistory(&msg)
+	case "w", "who":
+		response = "command.on_duty"
+	case "":
+		response = "command.help"
+	default:
+		response = "command.unknown"
+	}
+
+	text := s.userMessage(e.UserID, response, msg)
+	if err != nil {
+		text = fmt.Sprintf(":bangbang: `%s`", err)
+	}
+
+	if err := s.chat().PostEphemeral(e.ChannelID, e.UserID, text); err != nil {
+		s.log.Error(err)
+	}
+}
+
+// SlashCommandTake posts the preview of the override, the time is read in the
+// timezone of the caller and the override is created when it's confirmed
+func (s *Schedules) SlashCommandTake(e Event, data []string, msg *MessageData) error {
+	loc := s.userTimezone(e.UserID)
+
+	start, end, err := parseWindow(data[1:], time.Now().In(loc))
+	if err != nil {
+		return err
+	}
+
+	req := overrideRequest{Caller: e.UserID, Target: e.UserID, Start: start, End: end}.clamp(time.Now())
+	s.overrideData(msg, req, loc)
+
+	_, err = s.chat().PostAlert(e.ChannelID, "", AlertMessage{
+		Actions: []string{"take_confirm", "take_cancel"},
+		AlertID: req.String(),
+		Text:    s.message("command.take_preview", *msg),
+	})
+
+	return err
+}
@@ -35,6 +35,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var daemonTransport string
+
 // daemonCmd represents the sync command
 var daemonCmd = &cobra.Command{
 	Use:   "daemon",
@@ -42,11 +44,17 @@ var daemonCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		s := Schedules{mode: cmd.Use}
 
+		switch daemonTransport {
+		case "socket", "http":
+		default:
+			log.Fatalf("unknown transport: %s", daemonTransport)
+		}
+
 		if err := s.configGetSchedules(); err != nil {
 			log.Fatal(err)
 		}
 
-		if err := s.slackClientsWS(); err != nil {
+		if err := s.chatClients(); err != nil {
 			log.Fatal(err)
 		}
 	},
@@ -54,4 +62,6 @@ var daemonCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().StringVar(&daemonTransport, "transport", "socket", "Set how slack events are received: socket, http")
 }
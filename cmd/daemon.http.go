@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	daemonMux    = http.NewServeMux()
+	daemonRoutes = []string{}
+)
+
+func daemonHandle(pattern string, handler http.HandlerFunc) {
+	daemonRoutes = append(daemonRoutes, pattern)
+	daemonMux.HandleFunc(pattern, handler)
+}
+
+// daemonMaxBody is the limit of the request body read before the request is
+// authenticated, the slack and webhook payloads are much smaller
+const daemonMaxBody = 1 << 20
+
+// daemonReadBody reads the request body up to the limit, the error is sent to
+// the client
+func daemonReadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	// one byte over the limit tells a too large body from a body of the limit size
+	body, err := io.ReadAll(io.LimitReader(r.Body, daemonMaxBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(body) > daemonMaxBody {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// daemonServe starts the HTTP listener of the daemon, the listener is only
+// needed when a chat or a webhook has registered a route
+func daemonServe() (*http.Server, error) {
+	if len(daemonRoutes) < 1 {
+		return nil, nil
+	}
+
+	listen := viper.GetString("_daemon.listen")
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           daemonMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("http server failed - %s", err.Error())
+		}
+	}()
+
+	log.WithField("routes", daemonRoutes).Infof("listening on %s", listen)
+
+	return server, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ThreadReply adds the reply in the thread of an alert as a note of the alert
+func (s *Schedules) ThreadReply(e Event) {
+	if e.Bot && viper.GetBool("_opsgenie.notes.skip_bots") {
+		return
+	}
+
+	state, err := s.store.Thread(s.list[0].group, e.ChannelID, e.ThreadTimeStamp)
+	if err != nil {
+		s.log.Errorf("can't get the stored alert - %s", err.Error())
+
+		return
+	}
+
+	if state == nil {
+		return
+	}
+
+	author := e.UserID
+	if author == "" {
+		author = "bot"
+	} else if email, err := s.chat().GetUserEmail(e.UserID); err == nil && email != "" {
+		author = email
+	}
+
+	note := fmt.Sprintf("%s: %s", author, e.Data)
+
+	link, err := s.chat().GetPermalink(e.ChannelID, e.TimeStamp)
+	if err != nil {
+		s.log.Errorf("can't get permalink - %s", err.Error())
+	} else {
+		note = fmt.Sprintf("%s\n%s", note, link)
+	}
+
+	if err := s.oncallAddNote(state.AlertID, note); err != nil {
+		s.log.WithField("alert", state.AlertID).Errorf("can't add the alert note - %s", err.Error())
+	}
+}
+
+// alertUpdate attributes the ack or close to the chat user, the note links
+// the alert message. Without the email the provider shows the integration.
+func (s *Schedules) alertUpdate(e Event, action string) AlertUpdate {
+	update := AlertUpdate{Source: fmt.Sprintf("%s/%s", pkg, s.list[0].chat)}
+
+	author := e.UserID
+	if email, err := s.chat().GetUserEmail(e.UserID); err != nil || email == "" {
+		s.log.Warnf("can't get the email of %#v", e.UserID)
+	} else {
+		author = email
+		update.User = email
+	}
+
+	if name, err := s.chat().GetUserName(e.UserID); err == nil && name != "" {
+		author = fmt.Sprintf("%s (%s)", name, author)
+	}
+
+	update.Note = fmt.Sprintf("%s by %s in %s", action, author, s.list[0].chat)
+
+	link, err := s.chat().GetPermalink(e.ChannelID, e.TimeStamp)
+	if err != nil {
+		s.log.Errorf("can't get permalink - %s", err.Error())
+	} else {
+		update.Note = fmt.Sprintf("%s\n%s", update.Note, link)
+	}
+
+	return update
+}
+
+// alertAlias is the same for all the mentions in a thread, so the on-call
+// provider deduplicates them as well
+func alertAlias(channel, thread string) string {
+	return fmt.Sprintf("%s:%s:%s", pkg, channel, thread)
+}
+
+// alertClosed forgets the stored alert closed in the provider without the
+// webhook, so the thread can be paged again. The alert is kept open when the
+// provider can't be asked.
+func (s *Schedules) alertClosed(state AlertState) bool {
+	closed, err := s.oncallAlertClosed(state.AlertID)
+	if err != nil {
+		s.log.WithField("alert", state.AlertID).Warnf("can't get the alert status - %s", err.Error())
+
+		return false
+	}
+
+	if closed {
+		s.scheduler.Cancel(state.AlertID)
+		s.storeDelete(state.AlertID)
+	}
+
+	return closed
+}
+
+// AlertDuplicate adds the mention in an already paged thread as a note of its
+// alert instead of paging the on-duty once again
+func (s *Schedules) AlertDuplicate(e Event, state AlertState, link string) {
+	author := e.UserID
+	if email, err := s.chat().GetUserEmail(e.UserID); err == nil && email != "" {
+		author = email
+	}
+
+	if err := s.oncallAddNote(state.AlertID, fmt.Sprintf("%s: %s\n%s", author, e.Data, link)); err != nil {
+		s.log.WithField("alert", state.AlertID).Errorf("can't add the alert note - %s", err.Error())
+	}
+
+	// the first mention created the alert
+	if state.Mentions < 1 {
+		state.Mentions = 1
+	}
+
+	state.Mentions++
+
+	if err := s.store.Put(state); err != nil {
+		s.log.Errorf("can't store the alert - %s", err.Error())
+	}
+
+	data := s.messageData(e)
+	data.AlertID = state.AlertID
+	data.Count = state.Mentions
+	data.Priority = state.Priority
+
+	if err := s.chat().PostEphemeral(e.ChannelID, e.UserID, s.userMessage(e.UserID, "alert_create.duplicate", data)); err != nil {
+		s.log.Error(err)
+	}
+}
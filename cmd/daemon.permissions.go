@@ -0,0 +1,119 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Permission is who may run an action, the user is allowed when any of the
+// lists matches
+type Permission struct {
+	Teams      []string `mapstructure:"teams"`
+	UserGroups []string `mapstructure:"user_groups"`
+	Users      []string `mapstructure:"users"`
+}
+
+// permissionActions are the policy names of the alert actions
+var permissionActions = map[string]string{
+	"alert_acknowledge":       "ack",
+	"alert_close":             "close",
+	"alert_increase_priority": "escalate",
+}
+
+// authorize checks the policy of the action, the actions without a policy
+// are allowed to everyone. The denial is logged and shown to the user.
+func (s *Schedules) authorize(e Event, action string) bool {
+	policy, ok := s.list[0].permissions[action]
+	if !ok || s.permitted(policy, e.UserID) {
+		return true
+	}
+
+	s.log.Warnf("permission denied - %s can't %s (alert %#v)", e.UserID, action, e.AlertID)
+
+	data := s.messageData(e)
+	data.Action = action
+
+	if err := s.chat().PostEphemeral(e.ChannelID, e.UserID, s.userMessage(e.UserID, "permission_denied", data)); err != nil {
+		s.log.Error(err)
+	}
+
+	return false
+}
+
+func (s *Schedules) permitted(policy Permission, user string) bool {
+	if slices.Contains(policy.Users, user) {
+		return true
+	}
+
+	for _, group := range policy.UserGroups {
+		list, err := s.chatUserGroupMembers(group)
+		if err != nil {
+			s.log.Errorf("can't get the members of %#v - %s", group, err.Error())
+
+			continue
+		}
+
+		if slices.Contains(list, user) {
+			return true
+		}
+	}
+
+	if len(policy.Teams) < 1 {
+		return false
+	}
+
+	email, err := s.chat().GetUserEmail(user)
+	if err != nil || email == "" {
+		s.log.Warnf("can't get the email of %#v", user)
+
+		return false
+	}
+
+	for _, team := range policy.Teams {
+		list, err := s.oncallTeamMembers(team)
+		if err != nil {
+			s.log.Errorf("can't get the members of the team %#v - %s", team, err.Error())
+
+			continue
+		}
+
+		for _, member := range list {
+			if strings.EqualFold(member, email) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
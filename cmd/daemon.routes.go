@@ -0,0 +1,180 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Route sends the alerts from a channel, or with a keyword in the mention
+// text, to another schedule with its own priority and extra responders
+type Route struct {
+	Channel    string      `mapstructure:"channel"`
+	Keyword    string      `mapstructure:"keyword"`
+	Priority   string      `mapstructure:"priority"`
+	Responders []Responder `mapstructure:"responders"`
+	Schedule   string      `mapstructure:"schedule"`
+
+	keyword *regexp.Regexp
+}
+
+// chatRoute picks the schedule for the event, the button clicks and webhooks
+// keep the schedule the alert was created for
+func (s *Schedules) chatRoute(e Event) Schedule {
+	// the take and swap confirmations are routed as the command they came from
+	if e.AlertID != "" && !overrideAction(e.Action) {
+		state, err := s.store.Get(e.AlertID)
+		if err != nil {
+			s.log.Errorf("can't get the stored alert - %s", err.Error())
+		}
+
+		if state != nil {
+			return s.routeSchedule(state.Schedule)
+		}
+
+		return s.list[0]
+	}
+
+	// the schedule chosen in the form
+	if e.Form != nil && e.Form.Schedule != "" {
+		return s.routeSchedule(e.Form.Schedule)
+	}
+
+	for _, route := range s.list[0].routes {
+		if route.Channel != "" && !s.routeChannel(route.Channel, e.ChannelID) {
+			continue
+		}
+
+		if route.keyword != nil && !route.keyword.MatchString(e.Data) {
+			continue
+		}
+
+		item := s.routeSchedule(route.Schedule)
+		item.priority = route.Priority
+		item.responders = route.Responders
+
+		return item
+	}
+
+	return s.list[0]
+}
+
+// channelNames caches the channel names of the routes, the shortcuts are
+// routed without the mutex of the app
+type channelNames struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+// routeChannel matches the channel of the route by its id or name
+func (s *Schedules) routeChannel(channel, id string) bool {
+	if channel == id {
+		return true
+	}
+
+	s.channels.mu.Lock()
+	name, ok := s.channels.names[id]
+	s.channels.mu.Unlock()
+
+	if !ok {
+		n, err := s.chat().GetChannelName(id)
+		if err != nil {
+			s.log.Errorf("can't get the channel name - %s", err.Error())
+
+			return false
+		}
+
+		name = n
+
+		s.channels.mu.Lock()
+		s.channels.names[id] = name
+		s.channels.mu.Unlock()
+	}
+
+	return strings.TrimPrefix(channel, "#") == name
+}
+
+// routeSchedules lists the schedule of the app and of its routes
+func (s *Schedules) routeSchedules() []string {
+	list := []string{s.list[0].name}
+
+	for _, route := range s.list[0].routes {
+		if route.Schedule != "" {
+			list = appendUnique(list, route.Schedule)
+		}
+	}
+
+	return list
+}
+
+func (s *Schedules) routeSchedule(name string) Schedule {
+	item := s.list[0]
+
+	if name != "" && name != item.name {
+		item.name = name
+		item.duty = []string{name}
+	}
+
+	return item
+}
+
+// routed is the same app working with another schedule, the clients and the
+// caches are shared with the app
+func (s *Schedules) routed(item Schedule) *Schedules {
+	if s.users == nil {
+		s.users = make(map[string]string)
+	}
+
+	if s.groups == nil {
+		s.groups = make(map[string]map[string]string)
+	}
+
+	if s.locales == nil {
+		s.locales = make(map[string]string)
+	}
+
+	return &Schedules{
+		channels:  s.channels,
+		groups:    s.groups,
+		list:      []Schedule{item},
+		locales:   s.locales,
+		mode:      s.mode,
+		mu:        s.mu,
+		users:     s.users,
+		providers: s.providers,
+		chats:     s.chats,
+		scheduler: s.scheduler,
+		store:     s.store,
+		log:       s.log.WithField("schedule", item.name),
+	}
+}
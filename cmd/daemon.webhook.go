@@ -0,0 +1,167 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// webhookOpsgenie receives the alert actions from an Opsgenie outgoing webhook
+// integration, the integration must send the secret in the X-Opsgin-Secret header
+func webhookOpsgenie(store *alertStore, apps map[string]*Schedules) http.HandlerFunc {
+	secret := viper.GetString("_opsgenie.webhook.secret")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Opsgin-Secret")), []byte(secret)) != 1 {
+			log.Warn("opsgenie webhook with a wrong secret")
+
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var payload struct {
+			Action string `json:"action"`
+			Alert  struct {
+				AlertID  string `json:"alertId"`
+				Username string `json:"username"`
+			} `json:"alert"`
+		}
+
+		body, ok := daemonReadBody(w, r)
+		if !ok {
+			return
+		}
+
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+		switch payload.Action {
+		case "Acknowledge", "Close":
+		default:
+			log.Debugf("opsgenie webhook skipped: %v", payload.Action)
+			return
+		}
+
+		state, err := store.Get(payload.Alert.AlertID)
+		if err != nil {
+			log.Errorf("can't get the stored alert - %s", err.Error())
+			return
+		}
+
+		// the alert wasn't created by the daemon or it's already closed
+		if state == nil {
+			return
+		}
+
+		app, ok := apps[state.App]
+		if !ok {
+			return
+		}
+
+		go app.chatHandleEvent(Event{
+			Type:          "webhook",
+			Action:        payload.Action,
+			AlertID:       state.AlertID,
+			AlertPriority: state.Priority,
+			ChannelID:     state.ChannelID,
+			Data:          payload.Alert.Username,
+			OnDuty:        state.OnDuty,
+			TimeStamp:     state.MessageTS,
+		})
+	}
+}
+
+// Webhook shows in the chat what was done with the alert in Opsgenie and stops
+// its escalation, the alert itself is not touched
+func (s *Schedules) Webhook(e Event) {
+	var (
+		alertActions []string
+		alertColor   string
+		alertFields  = append(s.alertFields(e.AlertPriority, e.OnDuty, nil, 0), s.storedDirectiveFields(e.AlertID)...)
+		chatResponse string
+	)
+
+	s.scheduler.Cancel(e.AlertID)
+
+	// opsgenie sends the username, which is the email of the user
+	data := s.messageData(e)
+	data.Caller = e.Data
+	if strings.Contains(e.Data, "@") {
+		if uid, err := s.chat().GetUserByEmail(e.Data); err == nil {
+			data.Caller = s.chat().Mention(uid)
+		}
+	}
+
+	switch e.Action {
+	case "Close":
+		alertColor = "good"
+		chatResponse = "alert_close.success"
+
+		s.storeDelete(e.AlertID)
+	case "Acknowledge":
+		alertActions = []string{"alert_close"}
+		alertColor = "#039be5"
+		chatResponse = "alert_acknowledged.success"
+
+		s.storeUpdate(e, func(state *AlertState) {
+			state.Deadline = time.Time{}
+		})
+	default:
+		return
+	}
+
+	if err := s.chat().UpdateAlert(e.ChannelID, e.TimeStamp, AlertMessage{
+		Actions:  alertActions,
+		AlertID:  e.AlertID,
+		Color:    alertColor,
+		Fields:   alertFields,
+		Priority: e.AlertPriority,
+		Text:     s.message(chatResponse, data),
+	}); err != nil {
+		s.log.Error(err)
+	}
+}
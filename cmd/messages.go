@@ -0,0 +1,395 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MessageData is the context of the chat message templates
+// (_opsgenie.messages.*), the users are chat mentions
+type MessageData struct {
+	Action       string
+	AlertID      string
+	Caller       string
+	Count        int
+	Duration     string
+	End          string
+	Levels       []MessageLevel
+	LocalEnd     string
+	LocalStart   string
+	Next         string
+	NextPriority string
+	NextShift    string
+	OnDuty       []string
+	Priority     string
+	Remaining    string
+	Schedule     string
+	Shifts       []MessageShift
+	Start        string
+	User         string
+}
+
+// MessageLevel is the on-duty of an escalation level, 1 is the primary
+type MessageLevel struct {
+	Level int
+	Users []string
+}
+
+// MessageShift is a shift or an override of the schedule
+type MessageShift struct {
+	User  string
+	Start string
+	End   string
+}
+
+var messageFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+//go:embed locales/*.yaml
+var localeFiles embed.FS
+
+// defaultLocale has every message, the other locales fall back to it
+const defaultLocale = "en"
+
+// parseMessages compiles every message of the locale, a template that can't
+// be parsed or refers to an unknown field stops the daemon. The messages can
+// include each other with the template action.
+func parseMessages(locale string, text map[string]string) (*template.Template, error) {
+	tmpl := template.New(locale).Funcs(messageFuncs)
+
+	for name, value := range text {
+		if strings.Contains(value, "_user_") || strings.Contains(value, "_time_") {
+			return nil, fmt.Errorf("%s: the %s message uses the old placeholders, use {{ .Caller }}, {{ .OnDuty }} or {{ .Duration }} instead", locale, name)
+		}
+
+		if _, err := tmpl.New(name).Parse(value); err != nil {
+			return nil, fmt.Errorf("%s: can't parse the %s message - %s", locale, name, err)
+		}
+	}
+
+	for name := range text {
+		if err := tmpl.ExecuteTemplate(&bytes.Buffer{}, name, MessageData{}); err != nil {
+			return nil, fmt.Errorf("%s: bad %s message - %s", locale, name, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// readLocale flattens a locale file, the keys are the message names
+// (e.g. alert_close.success)
+func readLocale(r io.Reader) (map[string]string, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+
+	if err := v.ReadConfig(r); err != nil {
+		return nil, err
+	}
+
+	text := make(map[string]string)
+	for _, key := range v.AllKeys() {
+		text[key] = v.GetString(key)
+	}
+
+	return text, nil
+}
+
+// configGetMessages compiles the message catalog of every locale: the bundled
+// locales, the locale files from the _opsgenie.locales directory over them and
+// the _opsgenie.messages overrides of the _opsgenie.locale
+func configGetMessages() (map[string]*template.Template, error) {
+	locales := make(map[string]map[string]string)
+
+	load := func(file string, f io.ReadCloser) error {
+		defer f.Close()
+
+		text, err := readLocale(f)
+		if err != nil {
+			return fmt.Errorf("can't read the locale %s - %s", file, err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".yaml"), ".yml")
+		if locales[name] == nil {
+			locales[name] = make(map[string]string)
+		}
+
+		for key, value := range text {
+			locales[name][key] = value
+		}
+
+		return nil
+	}
+
+	bundled, err := fs.Glob(localeFiles, "locales/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range bundled {
+		f, err := localeFiles.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := load(file, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir := viper.GetString("_opsgenie.locales"); dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.y*ml"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := load(file, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	locale := viper.GetString("_opsgenie.locale")
+	if locales[locale] == nil {
+		return nil, fmt.Errorf("unknown locale %#v", locale)
+	}
+
+	prefix := "_opsgenie.messages."
+	for _, key := range viper.AllKeys() {
+		if strings.HasPrefix(key, prefix) {
+			if name, value, ok := legacyMessage(strings.TrimPrefix(key, prefix), viper.GetString(key)); ok {
+				locales[locale][name] = value
+			}
+		}
+	}
+
+	catalog := make(map[string]*template.Template)
+
+	for name, text := range locales {
+		for key, value := range locales[defaultLocale] {
+			if _, ok := text[key]; !ok {
+				text[key] = value
+			}
+		}
+
+		tmpl, err := parseMessages(name, text)
+		if err != nil {
+			return nil, err
+		}
+
+		catalog[name] = tmpl
+	}
+
+	return catalog, nil
+}
+
+// legacyMessages are the renamed messages, an empty name is a message that's
+// not used anymore
+var legacyMessages = map[string]string{
+	"command.duty_transferred": "",
+	"fields.priority_p1_after": "fields.priority_next",
+}
+
+// legacyMessage rewrites an override made before the messages were templates:
+// the old name and the _user_ and _time_ placeholders
+func legacyMessage(name, value string) (string, string, bool) {
+	if renamed, ok := legacyMessages[name]; ok {
+		if renamed == "" {
+			log.Warnf("_opsgenie.messages.%s is deprecated and not used anymore", name)
+
+			return "", "", false
+		}
+
+		log.Warnf("_opsgenie.messages.%s is deprecated, use _opsgenie.messages.%s", name, renamed)
+
+		if viper.IsSet("_opsgenie.messages." + renamed) {
+			return "", "", false
+		}
+
+		name = renamed
+	}
+
+	if !strings.Contains(value, "_user_") && !strings.Contains(value, "_time_") {
+		return name, value, true
+	}
+
+	user, duration := "{{ .Caller }}", "{{ .Duration }}"
+
+	switch name {
+	case "command.on_duty":
+		user = "{{ join .OnDuty \", \" }}"
+	case "fields.priority_next":
+		duration = "{{ .Remaining }}"
+	}
+
+	log.Warnf("_opsgenie.messages.%s uses the deprecated _user_ and _time_ placeholders, use %s and %s", name, user, duration)
+
+	return name, strings.NewReplacer("_user_", user, "_time_", duration).Replace(value), true
+}
+
+// configGetLocale is the locale of the app group and whether the locale of
+// the chat user is used for the replies only the user sees
+func configGetLocale(item string) (string, bool) {
+	locale := viper.GetString("_opsgenie.locale")
+	if key := fmt.Sprintf("%s.locale", item); viper.IsSet(key) {
+		locale = viper.GetString(key)
+	}
+
+	user := viper.GetBool("_opsgenie.user_locale")
+	if key := fmt.Sprintf("%s.user_locale", item); viper.IsSet(key) {
+		user = viper.GetBool(key)
+	}
+
+	return locale, user
+}
+
+// message renders the message in the locale of the app group
+func (s *Schedules) message(name string, data MessageData) string {
+	return s.localeMessage(s.list[0].locale, name, data)
+}
+
+// userMessage renders the message in the locale of the chat user when it's
+// enabled for the app group
+func (s *Schedules) userMessage(user, name string, data MessageData) string {
+	return s.localeMessage(s.userLocale(user), name, data)
+}
+
+// localeMessage renders the message of the catalog, the errors are logged and
+// the name is shown instead
+func (s *Schedules) localeMessage(locale, name string, data MessageData) string {
+	var buf bytes.Buffer
+
+	if err := s.list[0].messages[locale].ExecuteTemplate(&buf, name, data); err != nil {
+		s.log.Errorf("can't render the %s message - %s", name, err.Error())
+
+		return name
+	}
+
+	return buf.String()
+}
+
+// userLocale maps the chat locale of the user (en-US, ru) to the catalog, the
+// unknown locales get the locale of the app group
+func (s *Schedules) userLocale(user string) string {
+	locale := s.list[0].locale
+
+	if !s.list[0].userLocale || user == "" {
+		return locale
+	}
+
+	if s.locales == nil {
+		s.locales = make(map[string]string)
+	}
+
+	if cached, ok := s.locales[user]; ok {
+		return cached
+	}
+
+	l, err := s.chat().GetUserLocale(user)
+	if err != nil {
+		s.log.Warnf("can't get the user locale - %s", err.Error())
+
+		return locale
+	}
+
+	name := strings.ToLower(strings.SplitN(strings.Replace(l, "_", "-", -1), "-", 2)[0])
+	if _, ok := s.list[0].messages[name]; ok {
+		locale = name
+	}
+
+	s.locales[user] = locale
+
+	return locale
+}
+
+// messageData fills the context known from the event
+func (s *Schedules) messageData(e Event) MessageData {
+	data := MessageData{
+		AlertID:  e.AlertID,
+		Priority: e.AlertPriority,
+		Schedule: s.list[0].name,
+	}
+
+	if e.UserID != "" {
+		data.Caller = s.chat().Mention(e.UserID)
+	}
+
+	s.onDutyData(&data, e.OnDuty)
+
+	return data
+}
+
+// onDutyData fills the on-duty mentions, all of them in OnDuty and per
+// escalation level in Levels
+func (s *Schedules) onDutyData(data *MessageData, duty []OnCall) {
+	data.OnDuty = []string{}
+	data.Levels = []MessageLevel{}
+
+	for _, oncall := range duty {
+		mention := s.chat().Mention(oncall.User)
+		data.OnDuty = append(data.OnDuty, mention)
+
+		if n := len(data.Levels); n > 0 && data.Levels[n-1].Level == oncall.Level+1 {
+			data.Levels[n-1].Users = append(data.Levels[n-1].Users, mention)
+
+			continue
+		}
+
+		data.Levels = append(data.Levels, MessageLevel{Level: oncall.Level + 1, Users: []string{mention}})
+	}
+}
+
+// alertConfirm is the confirmation text of the priority increase button
+func (s *Schedules) alertConfirm() string {
+	if !viper.GetBool("_opsgenie.priority_increase.confirm") {
+		return ""
+	}
+
+	return s.message("alert_increase_priority.tip", MessageData{})
+}
@@ -0,0 +1,434 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+var errNotSupported = fmt.Errorf("not supported by the on-call provider")
+
+// OnCallProvider is implemented by every on-call backend (Opsgenie, PagerDuty,
+// Grafana OnCall), the backend is selected per config group with the provider key
+type OnCallProvider interface {
+	// GetOnCalls returns the users who are currently on call with their
+	// escalation level, the user is an email
+	GetOnCalls(ctx context.Context, schedule string) ([]OnCall, error)
+	CreateAlert(ctx context.Context, req AlertRequest) (string, error)
+	AckAlert(ctx context.Context, alertID string, update AlertUpdate) error
+	CloseAlert(ctx context.Context, alertID string, update AlertUpdate) error
+	// AlertClosed is whether the alert was closed (resolved) in the provider
+	AlertClosed(ctx context.Context, alertID string) (bool, error)
+	SetAlertPriority(ctx context.Context, alertID, priority string) error
+	AddResponders(ctx context.Context, alertID string, responders []Responder) error
+	AddNote(ctx context.Context, alertID, note string) error
+	CreateOverride(ctx context.Context, schedule, user string, start, end time.Time) error
+	// GetOverrides returns the current and the upcoming overrides of the schedule
+	GetOverrides(ctx context.Context, schedule string) ([]Shift, error)
+	// GetOverrideHistory returns the overrides of the schedule between start
+	// and end, the past ones are kept only in the timeline of some providers
+	GetOverrideHistory(ctx context.Context, schedule string, start, end time.Time) ([]Shift, error)
+	DeleteOverride(ctx context.Context, schedule, id string) error
+	// GetShifts returns the final timeline of the schedule between start and end
+	GetShifts(ctx context.Context, schedule string, start, end time.Time) ([]Shift, error)
+	// GetTeamMembers returns the emails of the members of the team
+	GetTeamMembers(ctx context.Context, team string) ([]string, error)
+}
+
+type AlertRequest struct {
+	// Alias is the deduplication key of the alert
+	Alias       string
+	Description string
+	Details     map[string]string
+	Entity      string
+	Message     string
+	Priority    string
+	Schedule    string
+	Source      string
+	Tags        []string
+}
+
+// detailsText is the details of the alert for the providers without them
+func (req AlertRequest) detailsText() string {
+	keys := []string{}
+	for key := range req.Details {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	lines := []string{}
+	for _, key := range keys {
+		if req.Details[key] != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", key, req.Details[key]))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// OnCall is a user on call, the level is the escalation level of the user
+// starting from 0 (the primary)
+type OnCall struct {
+	User  string `json:"user"`
+	Level int    `json:"level,omitempty"`
+}
+
+// Shift is a period of the schedule or an override (with the ID), the user is
+// an email
+type Shift struct {
+	ID    string
+	User  string
+	Start time.Time
+	End   time.Time
+}
+
+// mergeShifts sorts the shifts and joins the adjacent shifts of the same user
+func mergeShifts(shifts []Shift) []Shift {
+	sort.Slice(shifts, func(i, j int) bool {
+		return shifts[i].Start.Before(shifts[j].Start)
+	})
+
+	list := []Shift{}
+	for _, shift := range shifts {
+		if last := len(list) - 1; last >= 0 && list[last].User == shift.User && !shift.Start.After(list[last].End) {
+			if shift.End.After(list[last].End) {
+				list[last].End = shift.End
+			}
+
+			continue
+		}
+
+		list = append(list, shift)
+	}
+
+	return list
+}
+
+// AlertUpdate is who acked or closed the alert from the chat, the user is the
+// email of the chat user and the note links the alert message
+type AlertUpdate struct {
+	Note   string
+	Source string
+	User   string
+}
+
+// Responder is a user (by email) or a team (by name) added to an alert
+type Responder struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+}
+
+// EscalationStep changes the priority of an alert and optionally adds
+// responders when the time after the alert creation has passed
+type EscalationStep struct {
+	After      time.Duration `mapstructure:"after"`
+	Priority   string        `mapstructure:"priority"`
+	Responders []Responder   `mapstructure:"responders"`
+}
+
+// escalationNext is the first step from the given one that raises the
+// priority, the steps that aren't more severe than the alert are skipped
+func escalationNext(steps []EscalationStep, from int, priority string) int {
+	for idx := from; idx < len(steps); idx++ {
+		// P1 is the most severe
+		if priority == "" || steps[idx].Priority < priority {
+			return idx
+		}
+	}
+
+	return len(steps)
+}
+
+func newOnCallProvider(name string, conf map[string]string) (OnCallProvider, error) {
+	switch name {
+	case "opsgenie":
+		return newOpsgenieProvider(conf)
+	case "pagerduty":
+		return newPagerdutyProvider(conf)
+	case "grafana":
+		return newGrafanaProvider(conf)
+	default:
+		return nil, fmt.Errorf("unknown on-call provider %#v", name)
+	}
+}
+
+func (s *Schedules) oncallInit(item Schedule) (OnCallProvider, error) {
+	if s.providers == nil {
+		s.providers = make(map[string]OnCallProvider)
+	}
+
+	if provider, ok := s.providers[item.provider]; ok {
+		return provider, nil
+	}
+
+	provider, err := newOnCallProvider(item.provider, item.oncall)
+	if err != nil {
+		return nil, err
+	}
+
+	s.providers[item.provider] = provider
+
+	return provider, nil
+}
+
+func (s *Schedules) oncallGetSchedules(sn ...string) error {
+	ctx := context.Background()
+
+	for idx, item := range s.list {
+		if len(sn) > 0 && sn[0] != item.name {
+			continue
+		}
+
+		provider, err := s.oncallInit(item)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Schedule loading: %s", item.name)
+
+		s.list[idx].finalDuty = []OnCall{}
+		for _, team := range item.duty {
+			if strings.Contains(team, "@") {
+				s.list[idx].finalDuty = append(s.list[idx].finalDuty, OnCall{User: team})
+				continue
+			}
+
+			users, err := provider.GetOnCalls(ctx, team)
+			if err != nil {
+				log.Errorf("can't get on-call users of %#v - %s", team, err.Error())
+
+				continue
+			}
+
+			s.list[idx].finalDuty = append(s.list[idx].finalDuty, users...)
+		}
+	}
+
+	return nil
+}
+
+// onDuty is everyone on call found in the chat ordered by the escalation
+// level, a user is listed once on the lowest level
+func (s *Schedules) onDuty() []OnCall {
+	found := append([]OnCall{}, s.list[0].finalDuty...)
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Level < found[j].Level
+	})
+
+	duty := []OnCall{}
+	for _, oncall := range found {
+		if oncall.User == "" || slices.ContainsFunc(duty, func(d OnCall) bool { return d.User == oncall.User }) {
+			continue
+		}
+
+		duty = append(duty, oncall)
+	}
+
+	return duty
+}
+
+func (s *Schedules) oncallOverride(user string, start, end time.Time) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.CreateOverride(context.Background(), s.list[0].name, user, start, end)
+}
+
+// oncallAddAlert creates the alert for the schedule with the app tags, the
+// request carries the alias, description, summary, priority and extra tags
+func (s *Schedules) oncallAddAlert(req AlertRequest, responders []Responder) (string, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return "", err
+	}
+
+	req.Schedule = s.list[0].name
+	req.Tags = append([]string{pkg, s.list[0].group}, req.Tags...)
+
+	alertID, err := provider.CreateAlert(context.Background(), req)
+	if err != nil {
+		s.log.Error("failed to create an alert")
+		return "", err
+	}
+
+	// the extra responders of the route and the mention
+	if err := s.oncallAddResponders(alertID, append(s.list[0].responders, responders...)); err != nil {
+		s.log.Errorf("can't add the responders - %s", err.Error())
+	}
+
+	return alertID, nil
+}
+
+func (s *Schedules) oncallAddResponders(alertID string, responders []Responder) error {
+	if len(responders) < 1 {
+		return nil
+	}
+
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.AddResponders(context.Background(), alertID, responders)
+}
+
+func (s *Schedules) oncallAddNote(alertID, note string) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.AddNote(context.Background(), alertID, note)
+}
+
+func (s *Schedules) oncallCloseAlert(alertID string, update AlertUpdate) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.CloseAlert(context.Background(), alertID, update)
+}
+
+func (s *Schedules) oncallAlertClosed(alertID string) (bool, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return false, err
+	}
+
+	return provider.AlertClosed(context.Background(), alertID)
+}
+
+func (s *Schedules) oncallAckAlert(alertID string, update AlertUpdate) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.AckAlert(context.Background(), alertID, update)
+}
+
+func (s *Schedules) oncallIncreaseAlertPriority(alertID, priority string) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.SetAlertPriority(context.Background(), alertID, priority)
+}
+
+func (s *Schedules) oncallTeamMembers(team string) ([]string, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.GetTeamMembers(context.Background(), team)
+}
+
+func (s *Schedules) oncallShifts(start, end time.Time) ([]Shift, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return nil, err
+	}
+
+	shifts, err := provider.GetShifts(context.Background(), s.list[0].name, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeShifts(shifts), nil
+}
+
+func (s *Schedules) oncallOverrides() ([]Shift, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := provider.GetOverrides(context.Background(), s.list[0].name)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Start.Before(overrides[j].Start)
+	})
+
+	return overrides, nil
+}
+
+// oncallOverrideHistory is the overrides started between start and end, the
+// latest first
+func (s *Schedules) oncallOverrideHistory(start, end time.Time) ([]Shift, error) {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := provider.GetOverrideHistory(context.Background(), s.list[0].name, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []Shift{}
+	for _, override := range overrides {
+		if !override.Start.Before(start) && !override.Start.After(end) {
+			history = append(history, override)
+		}
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Start.After(history[j].Start)
+	})
+
+	return history, nil
+}
+
+func (s *Schedules) oncallDeleteOverride(id string) error {
+	provider, err := s.oncallInit(s.list[0])
+	if err != nil {
+		return err
+	}
+
+	return provider.DeleteOverride(context.Background(), s.list[0].name, id)
+}
@@ -36,13 +36,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	"github.com/opsgenie/opsgenie-go-sdk-v2/alert"
-	"github.com/opsgenie/opsgenie-go-sdk-v2/schedule"
 	log "github.com/sirupsen/logrus"
-	"github.com/slack-go/slack"
-	"github.com/slack-go/slack/socketmode"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -68,69 +66,172 @@ type Event struct {
 	Action          string
 	AlertID         string
 	AlertPriority   string
+	Bot             bool
 	ChannelID       string
 	Data            string
-	OnDuty          string
-	ResponseURL     string
+	Form            *AlertForm
+	OnDuty          []OnCall
 	ThreadTimeStamp string
 	TimeStamp       string
+	Type            string
 	UserID          string
-	IncreaseTimer   int
 }
 
 type Schedule struct {
-	// opsgenie
+	// on-call provider
 	duty       []string
-	finalDuty  []string
+	finalDuty  []OnCall
 	name       string
-	og_api_key string
-
-	// slack
-	api_key string
-	app_key string
-	filter  string
-	group   string
+	oncall     map[string]string
+	provider   string
+	escalation []EscalationStep
+	priority   string
+	reactions  map[string]string
+
+	alertTemplate *template.Template
+	locale        string
+	messages      map[string]*template.Template
+	permissions   map[string]Permission
+	responders    []Responder
+	userLocale    bool
+	routes        []Route
+
+	// chat
+	chat     string
+	chatConf map[string]string
+	filter   string
+	group    string
+	groupID  string
 }
 
 type Schedules struct {
-	groups map[string]string
-	list   []Schedule
-	mode   string
+	channels *channelNames
+	groups   map[string]map[string]string
+	list     []Schedule
+	locales  map[string]string
+	mode     string
+	users    map[string]string
+
+	// on-call providers
+	providers map[string]OnCallProvider
 
-	// event
+	// chat clients
+	chats map[string]ChatBackend
 
-	// opsgenie clients
-	ac *alert.Client
-	sc *schedule.Client
+	// daemon alerts
+	scheduler *Scheduler
+	store     *alertStore
 
-	// slack clients
-	slack *slack.Client
-	sm    *socketmode.Client
+	// chat events, webhooks and the escalation steps of an app are handled one
+	// at a time, the routed schedules share the mutex of the app
+	mu *sync.Mutex
 
 	log *log.Entry
 }
 
 func (s *Schedules) configGetSchedules() error {
+	s.log = log.WithField("mode", s.mode)
+
+	var messages map[string]*template.Template
+
+	if s.mode == "daemon" {
+		catalog, err := configGetMessages()
+		if err != nil {
+			return err
+		}
+
+		messages = catalog
+	}
+
 	for item := range viper.AllSettings() {
 		r, _ := regexp.Compile(`^_`)
 		if r.MatchString(item) {
 			continue
 		}
 
-		schedule := Schedule{group: item}
+		schedule := Schedule{group: item, provider: "opsgenie", chat: "slack"}
+
+		if provider := viper.GetString(fmt.Sprintf("%s.provider", item)); provider != "" {
+			schedule.provider = provider
+		}
+
+		if chat := viper.GetString(fmt.Sprintf("%s.chat", item)); chat != "" {
+			schedule.chat = chat
+		}
+
+		switch schedule.chat {
+		case "slack", "mattermost":
+		default:
+			return fmt.Errorf("unknown chat %#v in %#v", schedule.chat, item)
+		}
+
+		switch schedule.provider {
+		case "opsgenie", "pagerduty", "grafana":
+		default:
+			return fmt.Errorf("unknown on-call provider %#v in %#v", schedule.provider, item)
+		}
 
 		switch s.mode {
 		case "daemon":
-			data := viper.GetStringMapString(fmt.Sprintf("%s.opsgenie", item))
-			schedule.name = data["schedule"]
-			schedule.og_api_key = data["api_key"]
-
-			data = viper.GetStringMapString(fmt.Sprintf("%s.slack", item))
-			schedule.api_key = data["api_key"]
-			schedule.app_key = data["app_key"]
-			schedule.filter = data["user_group"]
+			schedule.oncall = viper.GetStringMapString(fmt.Sprintf("%s.%s", item, schedule.provider))
+			schedule.name = schedule.oncall["schedule"]
+
+			if schedule.provider == "pagerduty" && pagerdutyFrom(schedule.oncall) == "" {
+				return fmt.Errorf("pagerduty from is empty in %#v", item)
+			}
+			schedule.duty = []string{schedule.name}
+
+			escalation, err := configGetEscalation(item)
+			if err != nil {
+				return err
+			}
+
+			schedule.escalation = escalation
+
+			routes, err := configGetRoutes(item)
+			if err != nil {
+				return err
+			}
+
+			schedule.routes = routes
+
+			reactions, err := configGetReactions(item)
+			if err != nil {
+				return err
+			}
+
+			schedule.reactions = reactions
+
+			tmpl, err := parseAlertTemplates(item, configGetAlertTemplates(item))
+			if err != nil {
+				return err
+			}
+
+			schedule.alertTemplate = tmpl
+
+			schedule.locale, schedule.userLocale = configGetLocale(item)
+			if messages[schedule.locale] == nil {
+				return fmt.Errorf("unknown locale %#v in %#v", schedule.locale, item)
+			}
+
+			schedule.messages = messages
+
+			schedule.chatConf = viper.GetStringMapString(fmt.Sprintf("%s.%s", item, schedule.chat))
+			schedule.filter = schedule.chatConf["user_group"]
+
+			permissions, err := configGetPermissions(item, schedule.filter)
+			if err != nil {
+				return err
+			}
+
+			schedule.permissions = permissions
 		case "sync":
+			// a user group is either a list of schedules and emails, or a map
+			// with the provider and the same list under the schedules key
 			data := viper.GetStringSlice(item)
+			if viper.IsSet(fmt.Sprintf("%s.schedules", item)) {
+				data = viper.GetStringSlice(fmt.Sprintf("%s.schedules", item))
+			}
 
 			schedule.duty = data[0:]
 		default:
@@ -143,6 +244,172 @@ func (s *Schedules) configGetSchedules() error {
 	return nil
 }
 
+// configGetEscalation reads the escalation steps of the app group, the global
+// steps or a single step to P1 after the priority increase timer
+func configGetEscalation(item string) ([]EscalationStep, error) {
+	steps := []EscalationStep{}
+
+	key := fmt.Sprintf("%s.escalation", item)
+	if !viper.IsSet(key) {
+		key = "_opsgenie.escalation"
+	}
+
+	if viper.IsSet(key) {
+		if err := viper.UnmarshalKey(key, &steps); err != nil {
+			return nil, fmt.Errorf("can't parse %s - %s", key, err)
+		}
+	} else if timer := viper.GetInt("_opsgenie.priority_increase.timer"); timer > 0 {
+		steps = append(steps, EscalationStep{
+			After:    time.Duration(timer) * time.Second,
+			Priority: "P1",
+		})
+	}
+
+	for idx, step := range steps {
+		if step.After <= 0 || (idx > 0 && step.After <= steps[idx-1].After) {
+			return nil, fmt.Errorf("%s: the steps must be sorted by a positive after", key)
+		}
+
+		if !regexp.MustCompile(`^P[1-5]$`).MatchString(step.Priority) {
+			return nil, fmt.Errorf("%s: unknown priority %#v", key, step.Priority)
+		}
+
+		for _, responder := range step.Responders {
+			if responder.Type != "user" && responder.Type != "team" {
+				return nil, fmt.Errorf("%s: unknown responder type %#v", key, responder.Type)
+			}
+		}
+	}
+
+	return steps, nil
+}
+
+// configGetRoutes reads the routing table of the app group, the first route
+// matching the channel and the mention text is used
+func configGetRoutes(item string) ([]Route, error) {
+	routes := []Route{}
+	key := fmt.Sprintf("%s.routes", item)
+
+	if err := viper.UnmarshalKey(key, &routes); err != nil {
+		return nil, fmt.Errorf("can't parse %s - %s", key, err)
+	}
+
+	for idx, route := range routes {
+		if route.Channel == "" && route.Keyword == "" {
+			return nil, fmt.Errorf("%s: the route %d needs a channel or a keyword", key, idx)
+		}
+
+		if route.Priority != "" && !regexp.MustCompile(`^P[1-5]$`).MatchString(route.Priority) {
+			return nil, fmt.Errorf("%s: unknown priority %#v", key, route.Priority)
+		}
+
+		for _, responder := range route.Responders {
+			if responder.Type != "user" && responder.Type != "team" {
+				return nil, fmt.Errorf("%s: unknown responder type %#v", key, responder.Type)
+			}
+		}
+
+		if route.Keyword != "" {
+			r, err := regexp.Compile(route.Keyword)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad keyword %#v - %s", key, route.Keyword, err)
+			}
+
+			routes[idx].keyword = r
+		}
+	}
+
+	return routes, nil
+}
+
+// configGetAlertTemplates reads the alert templates of the app group, the
+// missing ones are taken from _opsgenie.alert
+func configGetAlertTemplates(item string) map[string]string {
+	text := make(map[string]string)
+
+	for _, name := range alertTemplates {
+		text[name] = viper.GetString(fmt.Sprintf("_opsgenie.alert.%s", name))
+
+		if key := fmt.Sprintf("%s.alert.%s", item, name); viper.IsSet(key) {
+			text[name] = viper.GetString(key)
+		}
+	}
+
+	return text
+}
+
+// configGetReactions maps the emoji names to the alert actions, the app group
+// reactions replace the global ones
+func configGetReactions(item string) (map[string]string, error) {
+	key := fmt.Sprintf("%s.reactions", item)
+	if !viper.IsSet(key) {
+		key = "_opsgenie.reactions"
+	}
+
+	reactions := make(map[string]string)
+
+	for emoji, action := range viper.GetStringMapString(key) {
+		switch action {
+		case "ack":
+			reactions[emoji] = "alert_acknowledge"
+		case "close":
+			reactions[emoji] = "alert_close"
+		case "increase":
+			reactions[emoji] = "alert_increase_priority"
+		default:
+			return nil, fmt.Errorf("%s: unknown action %#v of %#v", key, action, emoji)
+		}
+	}
+
+	return reactions, nil
+}
+
+// configGetPermissions reads the policies of the actions, the policy of the
+// app group replaces the global one. Without a policy take and release are
+// allowed to the members of the user group of the app only.
+func configGetPermissions(item, filter string) (map[string]Permission, error) {
+	permissions := make(map[string]Permission)
+
+	for _, action := range []string{"ack", "close", "escalate", "release", "take"} {
+		key := fmt.Sprintf("%s.permissions.%s", item, action)
+		if !viper.IsSet(key) {
+			key = fmt.Sprintf("_opsgenie.permissions.%s", action)
+		}
+
+		if !viper.IsSet(key) {
+			if action == "take" || action == "release" {
+				policy := Permission{}
+				if filter != "" {
+					policy.UserGroups = []string{filter}
+				}
+
+				permissions[action] = policy
+			}
+
+			continue
+		}
+
+		var policy Permission
+		if err := viper.UnmarshalKey(key, &policy); err != nil {
+			return nil, fmt.Errorf("can't parse %s - %s", key, err)
+		}
+
+		permissions[action] = policy
+	}
+
+	for _, key := range []string{fmt.Sprintf("%s.permissions", item), "_opsgenie.permissions"} {
+		for action := range viper.GetStringMap(key) {
+			switch action {
+			case "ack", "close", "escalate", "release", "take":
+			default:
+				return nil, fmt.Errorf("%s: unknown action %#v", key, action)
+			}
+		}
+	}
+
+	return permissions, nil
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -172,26 +439,17 @@ func init() {
 func initConfig() {
 	viper.AutomaticEnv()
 	viper.SetConfigFile(fmt.Sprintf("%s/%s", configPath, configFile))
-	viper.SetDefault("_opsgenie.messages.alert_acknowledged.failure", "Failed to update alert status :sob:")
-	viper.SetDefault("_opsgenie.messages.alert_acknowledged.success", "The engineer on duty has read the notification (_user_)")
-	viper.SetDefault("_opsgenie.messages.alert_close.failure", ":bangbang: Failed to close alert")
-	viper.SetDefault("_opsgenie.messages.alert_close.success", ":dizzy: The alert was closed")
-	viper.SetDefault("_opsgenie.messages.alert_create.failure", "I couldn't create an alert in OpsGenie :sob:")
-	viper.SetDefault("_opsgenie.messages.alert_create.success", "The engineer on duty has been notified and will be coming soon")
-	viper.SetDefault("_opsgenie.messages.alert_increase_priority.failure", ":bangbang: Failed to increase alert priority")
-	viper.SetDefault("_opsgenie.messages.alert_increase_priority.success", ":fire: The alert priority has been increased")
-	viper.SetDefault("_opsgenie.messages.alert_increase_priority.tip", ":no_entry_sign: You can increase the priority of the notification, but be careful not to do this if it is not necessary")
-	viper.SetDefault("_opsgenie.messages.command.duty_transferred", "The duty was transferred to you for _time_")
-	viper.SetDefault("_opsgenie.messages.command.duty_was_taken", "The duty was taken by _user_ for _time_")
-	viper.SetDefault("_opsgenie.messages.command.help", "Available arguments for slash commands: *take*, *who*, *w*")
-	viper.SetDefault("_opsgenie.messages.command.on_duty", "The engineer on duty - _user_")
-	viper.SetDefault("_opsgenie.messages.command.unknown", ":bangbang: Unknown command")
-	viper.SetDefault("_opsgenie.messages.fields.on_duty", "On duty")
-	viper.SetDefault("_opsgenie.messages.fields.priority", "Priority")
-	viper.SetDefault("_opsgenie.messages.fields.priority_p1_after", "P1 after _time_")
+	viper.SetDefault("_daemon.listen", ":8080")
+	viper.SetDefault("_daemon.store_ttl", "720h")
+	viper.SetDefault("_opsgenie.alert.description", "{{ with .Permalink }}slack:{{ . }}\n{{ end }}{{ .Text }}")
+	viper.SetDefault("_opsgenie.alert.entity", "{{ .Channel.Name }}")
+	viper.SetDefault("_opsgenie.alert.message", "{{ with .Summary }}{{ . }}{{ else }}{{ .Reporter.Name }} called the on-duty in #{{ .Channel.Name }}{{ end }}")
+	viper.SetDefault("_opsgenie.locale", defaultLocale)
+	viper.SetDefault("_opsgenie.notes.skip_bots", true)
 	viper.SetDefault("_opsgenie.priority", "P5")
 	viper.SetDefault("_opsgenie.priority_increase.confirm", true)
 	viper.SetDefault("_opsgenie.priority_increase.timer", 0)
+	viper.SetDefault("_opsgenie.user_locale", false)
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.SetEnvPrefix(pkg)
 
@@ -0,0 +1,267 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// schedulerJob calls tick every period until the deadline and expire once the
+// deadline is reached, the calls of one job never overlap. The calls are made
+// under the lock of the job (the mutex of the app) when it's set.
+type schedulerJob struct {
+	key      string
+	deadline time.Time
+	period   time.Duration
+	lock     *sync.Mutex
+	tick     func(remaining time.Duration)
+	expire   func()
+
+	next  time.Time
+	index int
+
+	mu        sync.Mutex
+	cancelled bool
+}
+
+type schedulerHeap []*schedulerJob
+
+func (h schedulerHeap) Len() int           { return len(h) }
+func (h schedulerHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+
+func (h schedulerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *schedulerHeap) Push(x interface{}) {
+	job := x.(*schedulerJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *schedulerHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*h = old[:len(old)-1]
+
+	return job
+}
+
+// Scheduler owns the deadlines of all alerts of the daemon in one timer heap
+// instead of a sleeping goroutine per alert
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs schedulerHeap
+	keys map[string]*schedulerJob
+	wake chan struct{}
+}
+
+func newScheduler() *Scheduler {
+	return &Scheduler{
+		keys: make(map[string]*schedulerJob),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Schedule adds a job, a job with the same key is cancelled first. With the
+// lock the job is cancelled by the holder of the lock without waiting, the
+// expire call can schedule the next job of the key.
+func (sc *Scheduler) Schedule(key string, deadline time.Time, period time.Duration, lock *sync.Mutex, tick func(time.Duration), expire func()) {
+	sc.Cancel(key)
+
+	job := &schedulerJob{
+		key:      key,
+		deadline: deadline,
+		period:   period,
+		lock:     lock,
+		tick:     tick,
+		expire:   expire,
+		next:     time.Now(),
+	}
+
+	sc.mu.Lock()
+	sc.keys[key] = job
+	heap.Push(&sc.jobs, job)
+	sc.mu.Unlock()
+
+	sc.notify()
+}
+
+// Cancel removes the job and waits for its running call to finish, so the
+// caller can update the alert without being overwritten by a stale tick
+func (sc *Scheduler) Cancel(key string) bool {
+	sc.mu.Lock()
+	job, ok := sc.keys[key]
+	if ok {
+		delete(sc.keys, key)
+
+		if job.index >= 0 {
+			heap.Remove(&sc.jobs, job.index)
+		}
+	}
+	sc.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	job.mu.Lock()
+	job.cancelled = true
+	job.mu.Unlock()
+
+	sc.notify()
+
+	return true
+}
+
+func (sc *Scheduler) Active(key string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	_, ok := sc.keys[key]
+
+	return ok
+}
+
+func (sc *Scheduler) notify() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		sc.mu.Lock()
+		now := time.Now()
+		wait := time.Hour
+
+		for len(sc.jobs) > 0 {
+			job := sc.jobs[0]
+			if job.next.After(now) {
+				wait = job.next.Sub(now)
+				break
+			}
+
+			// the job is kept in the keys until expire starts, so it can be
+			// cancelled in the meantime
+			if !job.deadline.After(now) {
+				heap.Pop(&sc.jobs)
+
+				go sc.callExpire(job)
+
+				continue
+			}
+
+			remaining := job.deadline.Sub(now)
+			go sc.callTick(job, remaining)
+
+			job.next = now.Add(job.period)
+			if job.next.After(job.deadline) {
+				job.next = job.deadline
+			}
+
+			heap.Fix(&sc.jobs, job.index)
+		}
+		sc.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// callTick skips the tick when the previous call of the job is still running
+// or the lock is busy
+func (sc *Scheduler) callTick(job *schedulerJob, remaining time.Duration) {
+	if job.lock != nil {
+		if !job.lock.TryLock() {
+			return
+		}
+		defer job.lock.Unlock()
+	}
+
+	if !job.mu.TryLock() {
+		return
+	}
+	defer job.mu.Unlock()
+
+	if job.cancelled {
+		return
+	}
+
+	job.tick(remaining)
+}
+
+func (sc *Scheduler) callExpire(job *schedulerJob) {
+	if job.lock != nil {
+		job.lock.Lock()
+		defer job.lock.Unlock()
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.cancelled {
+		return
+	}
+
+	job.cancelled = true
+
+	sc.mu.Lock()
+	if sc.keys[job.key] == job {
+		delete(sc.keys, job.key)
+	}
+	sc.mu.Unlock()
+
+	job.expire()
+}
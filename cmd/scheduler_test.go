@@ -0,0 +1,213 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func runScheduler(t *testing.T) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sc := newScheduler()
+	go sc.Run(ctx)
+
+	return sc
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestSchedulerSchedule(t *testing.T) {
+	sc := runScheduler(t)
+
+	var ticks, expires int32
+
+	sc.Schedule("a", time.Now().Add(50*time.Millisecond), 10*time.Millisecond, nil,
+		func(time.Duration) { atomic.AddInt32(&ticks, 1) },
+		func() { atomic.AddInt32(&expires, 1) },
+	)
+
+	if !sc.Active("a") {
+		t.Fatal("the job is not active")
+	}
+
+	waitFor(t, "expire", func() bool { return atomic.LoadInt32(&expires) == 1 })
+	waitFor(t, "the job to be removed", func() bool { return !sc.Active("a") })
+
+	if atomic.LoadInt32(&ticks) < 1 {
+		t.Error("no ticks before the deadline")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&expires); n != 1 {
+		t.Errorf("expire was called %d times", n)
+	}
+}
+
+func TestSchedulerCancelDuringTick(t *testing.T) {
+	sc := runScheduler(t)
+
+	var (
+		ticking  = make(chan struct{})
+		release  = make(chan struct{})
+		once     sync.Once
+		finished int32
+		expires  int32
+	)
+
+	sc.Schedule("a", time.Now().Add(100*time.Millisecond), time.Hour, nil,
+		func(time.Duration) {
+			once.Do(func() { close(ticking) })
+			<-release
+			atomic.StoreInt32(&finished, 1)
+		},
+		func() { atomic.AddInt32(&expires, 1) },
+	)
+
+	<-ticking
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+
+	if !sc.Cancel("a") {
+		t.Fatal("the job was not cancelled")
+	}
+
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("cancel returned before the running tick")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if atomic.LoadInt32(&expires) != 0 {
+		t.Error("the cancelled job expired")
+	}
+}
+
+func TestSchedulerCancelDuringExpire(t *testing.T) {
+	sc := runScheduler(t)
+
+	var (
+		mu       sync.Mutex
+		expiring = make(chan struct{})
+		state    string
+	)
+
+	// the expire step is running, the cancel of the lock holder comes after it
+	sc.Schedule("a", time.Now(), time.Hour, &mu, func(time.Duration) {}, func() {
+		close(expiring)
+		time.Sleep(20 * time.Millisecond)
+		state = "escalated"
+	})
+
+	<-expiring
+
+	mu.Lock()
+	sc.Cancel("a")
+	if state != "escalated" {
+		t.Errorf("the cancel overlapped the expire step, state %#v", state)
+	}
+	state = "acknowledged"
+	mu.Unlock()
+
+	// the expire step is due but waits for the lock, the cancel stops it
+	var expires int32
+
+	mu.Lock()
+	sc.Schedule("b", time.Now(), time.Hour, &mu, func(time.Duration) {}, func() { atomic.AddInt32(&expires, 1) })
+	time.Sleep(20 * time.Millisecond)
+
+	if !sc.Cancel("b") {
+		t.Error("the due job was not cancelled")
+	}
+	mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	if atomic.LoadInt32(&expires) != 0 {
+		t.Error("the cancelled job expired")
+	}
+
+	if sc.Active("b") {
+		t.Error("the cancelled job is active")
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	sc := runScheduler(t)
+
+	var (
+		mu    sync.Mutex
+		steps int32
+		step  func()
+	)
+
+	step = func() {
+		if atomic.AddInt32(&steps, 1) < 3 {
+			sc.Schedule("a", time.Now().Add(10*time.Millisecond), time.Hour, &mu, func(time.Duration) {}, step)
+		}
+	}
+
+	sc.Schedule("a", time.Now().Add(10*time.Millisecond), time.Hour, &mu, func(time.Duration) {}, step)
+
+	waitFor(t, "the steps", func() bool { return atomic.LoadInt32(&steps) == 3 })
+	waitFor(t, "the job to be removed", func() bool { return !sc.Active("a") })
+
+	// scheduling the key again replaces the job
+	var first, second int32
+
+	sc.Schedule("b", time.Now().Add(30*time.Millisecond), time.Hour, nil, func(time.Duration) {}, func() { atomic.AddInt32(&first, 1) })
+	sc.Schedule("b", time.Now().Add(30*time.Millisecond), time.Hour, nil, func(time.Duration) {}, func() { atomic.AddInt32(&second, 1) })
+
+	waitFor(t, "the second job", func() bool { return atomic.LoadInt32(&second) == 1 })
+
+	if atomic.LoadInt32(&first) != 0 {
+		t.Error("the replaced job expired")
+	}
+}
@@ -0,0 +1,480 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var storeBucket = []byte("alerts")
+
+// storeMessages and storeThreads index the alerts by app/channel/ts of the
+// alert message and of the thread
+var (
+	storeMessages = []byte("messages")
+	storeThreads  = []byte("threads")
+)
+
+// AlertState links an on-call alert with the chat message it was posted in,
+// it's kept until the alert is closed so the daemon can resume after restart
+type AlertState struct {
+	AlertID   string    `json:"alert_id"`
+	App       string    `json:"app"`
+	ChannelID string    `json:"channel_id"`
+	Created   time.Time `json:"created"`
+	Creator   string    `json:"creator"`
+	Deadline  time.Time `json:"deadline,omitempty"`
+	Mentions  int       `json:"mentions,omitempty"`
+	MessageTS string    `json:"message_ts"`
+	OnDuty    onDuty    `json:"on_duty"`
+	Priority  string    `json:"priority"`
+	Schedule  string    `json:"schedule,omitempty"`
+	Step      int       `json:"step"`
+	Tags      []string  `json:"tags,omitempty"`
+	Teams     []string  `json:"teams,omitempty"`
+	ThreadTS  string    `json:"thread_ts"`
+}
+
+// onDuty reads the single user the states were stored with before the
+// escalation levels as the primary
+type onDuty []OnCall
+
+func (d *onDuty) UnmarshalJSON(data []byte) error {
+	var user string
+	if err := json.Unmarshal(data, &user); err == nil {
+		*d = onDuty{}
+		if user != "" {
+			*d = onDuty{{User: user}}
+		}
+
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]OnCall)(d))
+}
+
+// alertStore keeps the alert states in a bolt database, without a database
+// path the states are kept in memory and lost on restart
+type alertStore struct {
+	db *bolt.DB
+
+	mu  sync.Mutex
+	mem map[string]AlertState
+}
+
+func newAlertStore(path string) (*alertStore, error) {
+	st := &alertStore{mem: make(map[string]AlertState)}
+
+	if path == "" {
+		log.Warn("the alert store path is empty, the alerts will be lost on restart")
+
+		return st, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(storeInit); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	log.Debugf("Using alert store: %s", path)
+
+	st.db = db
+
+	return st, nil
+}
+
+// storeInit creates the buckets, the index is built for the stores written
+// before it
+func storeInit(tx *bolt.Tx) error {
+	bucket, err := tx.CreateBucketIfNotExists(storeBucket)
+	if err != nil {
+		return err
+	}
+
+	if tx.Bucket(storeThreads) != nil {
+		return nil
+	}
+
+	for _, name := range [][]byte{storeMessages, storeThreads} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		var state AlertState
+
+		if err := json.Unmarshal(v, &state); err != nil {
+			log.Warnf("can't decode the stored alert %s - %s", k, err.Error())
+
+			return nil
+		}
+
+		return storeIndex(tx, state, k)
+	})
+}
+
+// storeIndex puts the index keys of the state, a nil alert id deletes them
+func storeIndex(tx *bolt.Tx, state AlertState, alertID []byte) error {
+	keys := map[string]string{
+		string(storeMessages): state.MessageTS,
+		string(storeThreads):  state.ThreadTS,
+	}
+
+	for name, ts := range keys {
+		if ts == "" {
+			continue
+		}
+
+		bucket := tx.Bucket([]byte(name))
+		key := []byte(state.App + "/" + state.ChannelID + "/" + ts)
+
+		if alertID == nil {
+			// the key may be taken by another alert in the same thread
+			if string(bucket.Get(key)) != state.AlertID {
+				continue
+			}
+
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := bucket.Put(key, alertID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeGet decodes the state of the alert, nil when the alert is unknown
+func storeGet(tx *bolt.Tx, alertID []byte) (*AlertState, error) {
+	data := tx.Bucket(storeBucket).Get(alertID)
+	if data == nil {
+		return nil, nil
+	}
+
+	state := &AlertState{}
+
+	return state, json.Unmarshal(data, state)
+}
+
+func (st *alertStore) Put(state AlertState) error {
+	if st.db == nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		st.mem[state.AlertID] = state
+
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(state.AlertID)
+
+		prev, err := storeGet(tx, key)
+		if err != nil {
+			log.Warnf("can't decode the stored alert %s - %s", key, err.Error())
+		} else if prev != nil {
+			if err := storeIndex(tx, *prev, nil); err != nil {
+				return err
+			}
+		}
+
+		if err := storeIndex(tx, state, key); err != nil {
+			return err
+		}
+
+		return tx.Bucket(storeBucket).Put(key, data)
+	})
+}
+
+// Get returns nil when the alert is unknown
+func (st *alertStore) Get(alertID string) (*AlertState, error) {
+	if st.db == nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		if state, ok := st.mem[alertID]; ok {
+			return &state, nil
+		}
+
+		return nil, nil
+	}
+
+	var state *AlertState
+
+	err := st.db.View(func(tx *bolt.Tx) (err error) {
+		state, err = storeGet(tx, []byte(alertID))
+
+		return err
+	})
+
+	return state, err
+}
+
+func (st *alertStore) Delete(alertID string) error {
+	if st.db == nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		delete(st.mem, alertID)
+
+		return nil
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(alertID)
+
+		state, err := storeGet(tx, key)
+		if err != nil {
+			log.Warnf("can't decode the stored alert %s - %s", key, err.Error())
+		} else if state != nil {
+			if err := storeIndex(tx, *state, nil); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(storeBucket).Delete(key)
+	})
+}
+
+func (st *alertStore) List(app string) ([]AlertState, error) {
+	list := []AlertState{}
+
+	if st.db == nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		for _, state := range st.mem {
+			if state.App == app {
+				list = append(list, state)
+			}
+		}
+
+		return list, nil
+	}
+
+	err := st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeBucket).ForEach(func(k, v []byte) error {
+			var state AlertState
+
+			if err := json.Unmarshal(v, &state); err != nil {
+				log.Warnf("can't decode the stored alert %s - %s", k, err.Error())
+
+				return nil
+			}
+
+			if state.App == app {
+				list = append(list, state)
+			}
+
+			return nil
+		})
+	})
+
+	return list, err
+}
+
+// Thread returns the alert posted in the thread, nil if there is none
+func (st *alertStore) Thread(app, channel, thread string) (*AlertState, error) {
+	return st.find(storeThreads, app, channel, thread, func(state AlertState) bool {
+		return state.ChannelID == channel && state.ThreadTS == thread
+	})
+}
+
+// Message returns the alert of the chat message, nil if there is none
+func (st *alertStore) Message(app, channel, ts string) (*AlertState, error) {
+	return st.find(storeMessages, app, channel, ts, func(state AlertState) bool {
+		return state.ChannelID == channel && state.MessageTS == ts
+	})
+}
+
+// find looks the alert up in the index, the memory store is searched through
+func (st *alertStore) find(index []byte, app, channel, ts string, match func(state AlertState) bool) (*AlertState, error) {
+	if st.db == nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		for _, state := range st.mem {
+			if state.App == app && match(state) {
+				return &state, nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	var state *AlertState
+
+	err := st.db.View(func(tx *bolt.Tx) (err error) {
+		alertID := tx.Bucket(index).Get([]byte(app + "/" + channel + "/" + ts))
+		if alertID == nil {
+			return nil
+		}
+
+		state, err = storeGet(tx, alertID)
+
+		return err
+	})
+
+	return state, err
+}
+
+func (st *alertStore) Close() error {
+	if st.db == nil {
+		return nil
+	}
+
+	return st.db.Close()
+}
+
+// storeUpdate changes the stored state of the alert, the alerts created before
+// the store was enabled are added with what's known from the event
+func (s *Schedules) storeUpdate(e Event, update func(state *AlertState)) {
+	state, err := s.store.Get(e.AlertID)
+	if err != nil {
+		s.log.Errorf("can't get the stored alert - %s", err.Error())
+
+		return
+	}
+
+	if state == nil {
+		state = &AlertState{
+			AlertID:   e.AlertID,
+			App:       s.list[0].group,
+			ChannelID: e.ChannelID,
+			MessageTS: e.TimeStamp,
+			OnDuty:    e.OnDuty,
+			Priority:  e.AlertPriority,
+			Schedule:  s.list[0].name,
+		}
+	}
+
+	update(state)
+
+	if err := s.store.Put(*state); err != nil {
+		s.log.Errorf("can't store the alert - %s", err.Error())
+	}
+}
+
+func (s *Schedules) storeDelete(alertID string) {
+	if err := s.store.Delete(alertID); err != nil {
+		s.log.Errorf("can't delete the stored alert - %s", err.Error())
+	}
+}
+
+// storeExpire deletes the alerts older than the TTL, the alerts acked or closed
+// in the provider are never deleted otherwise. The alerts stored without the
+// creation time and the countdown expire in the TTL from now
+func (s *Schedules) storeExpire(list []AlertState) []AlertState {
+	ttl := viper.GetDuration("_daemon.store_ttl")
+	escalation := s.list[0].escalation
+	now := time.Now()
+	kept := []AlertState{}
+
+	for _, state := range list {
+		if state.Created.IsZero() {
+			state.Created = now
+			if !state.Deadline.IsZero() && state.Step < len(escalation) {
+				state.Created = state.Deadline.Add(-escalation[state.Step].After)
+			}
+
+			if err := s.store.Put(state); err != nil {
+				s.log.Errorf("can't store the alert - %s", err.Error())
+			}
+		}
+
+		if ttl > 0 && now.Sub(state.Created) > ttl {
+			s.log.WithField("alert", state.AlertID).Debug("the stored alert has expired")
+			s.storeDelete(state.AlertID)
+
+			continue
+		}
+
+		kept = append(kept, state)
+	}
+
+	return kept
+}
+
+// storeResume restarts the escalations that were running when the daemon
+// stopped, the expired steps are applied right away
+func (s *Schedules) storeResume() error {
+	list, err := s.store.List(s.list[0].group)
+	if err != nil {
+		return err
+	}
+
+	escalation := s.list[0].escalation
+
+	for _, state := range s.storeExpire(list) {
+		if state.Deadline.IsZero() || state.Step >= len(escalation) {
+			continue
+		}
+
+		// the alerts stored before the steps were skipped by the priority
+		if step := escalationNext(escalation, state.Step, state.Priority); step != state.Step {
+			if step >= len(escalation) {
+				continue
+			}
+
+			state.Step = step
+			state.Deadline = state.Created.Add(escalation[step].After)
+		}
+
+		s.log.WithField("alert", state.AlertID).Infof("resuming the escalation, %s left", time.Until(state.Deadline).Round(time.Second))
+
+		s.routed(s.routeSchedule(state.Schedule)).AlertPriorityAutoIncrease(state)
+	}
+
+	return nil
+}
@@ -31,10 +31,56 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	syncCron     = ""
+	syncDryRun   = false
+	syncInterval = time.Duration(0)
+	syncJitter   = time.Duration(0)
+	syncOutput   = ""
 )
 
+type UserGroupMember struct {
+	ID    string `json:"id"`
+	Email string `json:"email,omitempty"`
+}
+
+func (m UserGroupMember) String() string {
+	if m.Email == "" {
+		return m.ID
+	}
+
+	return fmt.Sprintf("%s (%s)", m.ID, m.Email)
+}
+
+type UserGroupDiff struct {
+	Group   string            `json:"group"`
+	ID      string            `json:"id"`
+	Current []string          `json:"current"`
+	Desired []string          `json:"desired"`
+	Add     []UserGroupMember `json:"add"`
+	Remove  []UserGroupMember `json:"remove"`
+	Status  string            `json:"status,omitempty"`
+	Error   string            `json:"error,omitempty"`
+
+	chat ChatBackend
+}
+
 // syncCmd represents the sync command
 var syncCmd = &cobra.Command{
 	Use:   "sync",
@@ -46,16 +92,302 @@ var syncCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		if err := s.opsgenieGetSchedules(); err != nil {
-			log.Fatal(err)
+		if syncInterval == 0 && syncCron == "" {
+			if err := s.syncRun(cmd.OutOrStdout()); err != nil {
+				log.Fatal(err)
+			}
+
+			return
 		}
 
-		if err := s.slackUpdateUserGroup(); err != nil {
+		if err := s.syncLoop(cmd.OutOrStdout()); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
+func (s *Schedules) syncRun(w io.Writer) error {
+	if err := s.oncallGetSchedules(); err != nil {
+		return err
+	}
+
+	if !syncDryRun {
+		return s.chatUpdateUserGroup()
+	}
+
+	diffs, err := s.chatDiffUserGroups()
+	if err != nil {
+		return err
+	}
+
+	return syncPrintDiff(w, diffs)
+}
+
+func (s *Schedules) syncLoop(w io.Writer) error {
+	var next func(time.Time) time.Time
+
+	switch {
+	case syncInterval > 0 && syncCron != "":
+		return fmt.Errorf("the --interval and --cron flags can't be used together")
+	case syncInterval > 0:
+		next = func(t time.Time) time.Time {
+			return t.Add(syncInterval)
+		}
+	case syncInterval < 0:
+		return fmt.Errorf("the interval must be positive")
+	default:
+		schedule, err := cron.ParseStandard(syncCron)
+		if err != nil {
+			return fmt.Errorf("can't parse cron expression - %s", err)
+		}
+
+		next = schedule.Next
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	tick := next(time.Now())
+	if syncInterval > 0 {
+		tick = time.Now()
+	}
+
+	// the runs are sequential, so a run that takes longer than the interval
+	// skips the missed ticks instead of overlapping with the next one
+	for ; ; tick = next(time.Now()) {
+		wait := time.Until(tick)
+		if syncJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(syncJitter)))
+		}
+
+		log.Debugf("next sync at %s", time.Now().Add(wait).Format(time.RFC3339))
+
+		select {
+		case <-ctx.Done():
+			log.Info("sync loop stopped")
+
+			return nil
+		case <-time.After(wait):
+		}
+
+		started := time.Now()
+
+		if err := s.syncRun(w); err != nil {
+			log.Errorf("sync failed - %s", err.Error())
+		}
+
+		if elapsed := time.Since(started); next(started).Before(time.Now()) {
+			log.Warnf("sync took %s, missed ticks are skipped", elapsed.Round(time.Second))
+		}
+	}
+}
+
+func (s *Schedules) chatUpdateUserGroup() error {
+	diffs, err := s.chatDiffUserGroups()
+	if err != nil {
+		return err
+	}
+
+	status := map[string]int{}
+
+	for idx, diff := range diffs {
+		switch {
+		case diff.Error != "":
+			diffs[idx].Status = "failed"
+		case len(diff.Add) < 1 && len(diff.Remove) < 1:
+			diffs[idx].Status = "unchanged"
+		default:
+			diffs[idx].Status = "updated"
+
+			if err := diff.chat.UpdateUserGroupMembers(diff.ID, diff.Desired); err != nil {
+				diffs[idx].Error = err.Error()
+				diffs[idx].Status = "failed"
+			}
+		}
+
+		logger := s.log.WithFields(log.Fields{
+			"group":  diff.Group,
+			"status": diffs[idx].Status,
+		})
+
+		switch diffs[idx].Status {
+		case "failed":
+			logger.Errorf("failed to update the user group - %s", diffs[idx].Error)
+		case "updated":
+			logger.Infof("the user group has been updated: +%d -%d", len(diff.Add), len(diff.Remove))
+		default:
+			logger.Info("the user group is up to date")
+		}
+
+		status[diffs[idx].Status]++
+	}
+
+	s.log.WithFields(log.Fields{
+		"failed":    status["failed"],
+		"unchanged": status["unchanged"],
+		"updated":   status["updated"],
+	}).Info("user groups sync finished")
+
+	return nil
+}
+
+func (s *Schedules) chatDiffUserGroups() ([]UserGroupDiff, error) {
+	if err := s.chatGetUserGroups(); err != nil {
+		return nil, err
+	}
+
+	if err := s.chatFindUsers(); err != nil {
+		return nil, err
+	}
+
+	diffs := []UserGroupDiff{}
+
+	// the groups that can't be synced are reported with the error, so every
+	// configured group is in the diff
+	for _, item := range s.list {
+		if item.groupID == "" {
+			diff := UserGroupDiff{Group: item.group, Error: "can't find the user group"}
+			if len(item.duty) < 1 {
+				diff.Error = "there are no schedules of the user group"
+			}
+
+			diffs = append(diffs, diff)
+
+			continue
+		}
+
+		duty := syncDesiredMembers(item.finalDuty)
+
+		if len(duty) < 1 {
+			s.log.WithField("group", item.group).Warn("there are no on-duty on this calendar")
+
+			diffs = append(diffs, UserGroupDiff{Group: item.group, ID: item.groupID, Error: "there are no on-duty on this calendar"})
+
+			continue
+		}
+
+		chat, err := s.chatInit(item)
+		if err != nil {
+			return nil, err
+		}
+
+		diff := UserGroupDiff{
+			Group:   item.group,
+			ID:      item.groupID,
+			Desired: duty,
+			chat:    chat,
+		}
+
+		current, err := chat.GetUserGroupMembers(item.groupID)
+		if err != nil {
+			s.log.WithField("group", item.group).Errorf("can't get user group members - %s", err.Error())
+
+			diff.Error = err.Error()
+			diffs = append(diffs, diff)
+
+			continue
+		}
+
+		diff.Current = current
+
+		for _, uid := range duty {
+			if !slices.Contains(current, uid) {
+				diff.Add = append(diff.Add, s.syncMember(item, uid))
+			}
+		}
+
+		for _, uid := range current {
+			if !slices.Contains(duty, uid) {
+				diff.Remove = append(diff.Remove, s.syncMember(item, uid))
+			}
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Group < diffs[j].Group
+	})
+
+	return diffs, nil
+}
+
+// syncMember looks up the email of the member for the dry-run output only, the
+// sync itself uses the emails that are already known
+func (s *Schedules) syncMember(item Schedule, uid string) UserGroupMember {
+	if !syncDryRun {
+		return UserGroupMember{ID: uid, Email: s.users[uid]}
+	}
+
+	return s.chatUserMember(item, uid)
+}
+
+// syncDesiredMembers drops users that were not found in the chat and duplicates
+// that appear when the same person is in several schedules of one group, only
+// the primary on-duty are the members of the user group
+func syncDesiredMembers(finalDuty []OnCall) []string {
+	duty := []string{}
+
+	for _, oncall := range finalDuty {
+		if oncall.User == "" || oncall.Level > 0 || slices.Contains(duty, oncall.User) {
+			continue
+		}
+
+		duty = append(duty, oncall.User)
+	}
+
+	return duty
+}
+
+func syncPrintDiff(w io.Writer, diffs []UserGroupDiff) error {
+	switch syncOutput {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(diffs)
+	case "text":
+	default:
+		return fmt.Errorf("unknown output format %#v", syncOutput)
+	}
+
+	for _, diff := range diffs {
+		if diff.ID == "" {
+			fmt.Fprintf(w, "@%s\n", diff.Group)
+		} else {
+			fmt.Fprintf(w, "@%s (%s)\n", diff.Group, diff.ID)
+		}
+
+		if diff.Error != "" {
+			fmt.Fprintf(w, "  ! %s\n", diff.Error)
+
+			continue
+		}
+
+		if len(diff.Add) < 1 && len(diff.Remove) < 1 {
+			fmt.Fprintln(w, "  = no changes")
+
+			continue
+		}
+
+		for _, member := range diff.Add {
+			fmt.Fprintf(w, "  + %s\n", member)
+		}
+
+		for _, member := range diff.Remove {
+			fmt.Fprintf(w, "  - %s\n", member)
+		}
+	}
+
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringVar(&syncCron, "cron", "", "Run the sync continuously on a cron schedule, e.g. \"*/5 * * * *\"")
+	syncCmd.Flags().DurationVar(&syncInterval, "interval", 0, "Run the sync continuously with the given interval, e.g. 5m")
+	syncCmd.Flags().DurationVar(&syncJitter, "jitter", 0, "Add a random delay up to the given duration before every continuous run")
+	syncCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "Print the user group membership changes without applying them")
+	syncCmd.Flags().StringVar(&syncOutput, "output", "text", "Set the dry-run output format: text, json")
 }
@@ -0,0 +1,191 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// the zones of the chat users in the images without tzdata
+	_ "time/tzdata"
+)
+
+const windowUsage = "enter the time as 2h, 2h from 14:00, tomorrow 09:00-18:00 or until friday"
+
+// windowDay is a day of the window, the weekdays are the next such day
+type windowDay struct {
+	date    time.Time
+	set     bool
+	weekday bool
+}
+
+func parseWindowDay(args []string, now time.Time) (windowDay, []string) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	if len(args) < 1 {
+		return windowDay{date: today}, args
+	}
+
+	switch token := strings.ToLower(args[0]); token {
+	case "today":
+		return windowDay{date: today, set: true}, args[1:]
+	case "tomorrow":
+		return windowDay{date: today.AddDate(0, 0, 1), set: true}, args[1:]
+	default:
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			name := strings.ToLower(wd.String())
+			if token == name || token == name[:3] {
+				days := (int(wd) - int(now.Weekday()) + 7) % 7
+
+				return windowDay{date: today.AddDate(0, 0, days), set: true, weekday: true}, args[1:]
+			}
+		}
+
+		if date, err := time.ParseInLocation("2006-01-02", token, now.Location()); err == nil {
+			return windowDay{date: date, set: true}, args[1:]
+		}
+	}
+
+	return windowDay{date: today}, args
+}
+
+// parseWindowClock is the wall clock time of the day, so the hours are kept on
+// the days of the DST change
+func parseWindowClock(day time.Time, text string) (time.Time, error) {
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %#v, %s", text, windowUsage)
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, day.Location()), nil
+}
+
+// parseWindow reads the time of take and swap in the timezone of now:
+//
+//	2h                     from now for the duration
+//	2h from [day] 14:00    from the time for the duration
+//	[day] 09:00-18:00      the range, the end before the start is the next day
+//	until [day] [18:00]    from now until the time or the start of the day
+//
+// the day is today, tomorrow, a weekday or a 2006-01-02 date
+func parseWindow(args []string, now time.Time) (time.Time, time.Time, error) {
+	var start, end time.Time
+
+	if len(args) < 1 {
+		return start, end, fmt.Errorf("to use the command, %s", windowUsage)
+	}
+
+	if duration, err := time.ParseDuration(args[0]); err == nil {
+		if duration <= 0 {
+			return start, end, fmt.Errorf("the duration must be positive")
+		}
+
+		start = now
+
+		if len(args) > 1 {
+			if strings.ToLower(args[1]) != "from" {
+				return start, end, fmt.Errorf("unexpected %#v, %s", args[1], windowUsage)
+			}
+
+			day, rest := parseWindowDay(args[2:], now)
+			if len(rest) != 1 {
+				return start, end, fmt.Errorf("to use the command, %s", windowUsage)
+			}
+
+			var err error
+			if start, err = parseWindowClock(day.date, rest[0]); err != nil {
+				return start, end, err
+			}
+
+			// the time has passed today
+			if !day.set && start.Before(now) {
+				start = start.AddDate(0, 0, 1)
+			}
+		}
+
+		end = start.Add(duration)
+	} else if strings.ToLower(args[0]) == "until" {
+		day, rest := parseWindowDay(args[1:], now)
+		start = now
+
+		switch {
+		case len(rest) == 0 && day.set:
+			end = day.date
+		case len(rest) == 1:
+			var err error
+			if end, err = parseWindowClock(day.date, rest[0]); err != nil {
+				return start, end, err
+			}
+		default:
+			return start, end, fmt.Errorf("to use the command, %s", windowUsage)
+		}
+
+		// the time has passed today or it's the same weekday
+		switch {
+		case end.After(now):
+		case day.weekday:
+			end = end.AddDate(0, 0, 7)
+		case !day.set:
+			end = end.AddDate(0, 0, 1)
+		}
+	} else {
+		day, rest := parseWindowDay(args, now)
+
+		clocks := []string{}
+		if len(rest) == 1 {
+			clocks = strings.Split(rest[0], "-")
+		}
+
+		if len(clocks) != 2 {
+			return start, end, fmt.Errorf("to use the command, %s", windowUsage)
+		}
+
+		var err error
+		if start, err = parseWindowClock(day.date, clocks[0]); err != nil {
+			return start, end, err
+		}
+
+		if end, err = parseWindowClock(day.date, clocks[1]); err != nil {
+			return start, end, err
+		}
+
+		if !end.After(start) {
+			end = end.AddDate(0, 0, 1)
+		}
+	}
+
+	if !end.After(now) {
+		return start, end, fmt.Errorf("the time has already passed")
+	}
+
+	return start, end, nil
+}
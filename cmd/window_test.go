@@ -0,0 +1,109 @@
+/*
+Copyright © 2022 Denis Halturin <dhalturin@hotmail.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, loc)
+	}
+
+	// friday, the DST starts on sunday 29 march at 02:00
+	now := at(time.March, 27, 15, 30)
+
+	tests := []struct {
+		args  string
+		start time.Time
+		end   time.Time
+	}{
+		{"2h", now, at(time.March, 27, 17, 30)},
+		{"90m", now, at(time.March, 27, 17, 0)},
+		{"2h from 16:00", at(time.March, 27, 16, 0), at(time.March, 27, 18, 0)},
+		{"2h from 14:00", at(time.March, 28, 14, 0), at(time.March, 28, 16, 0)},
+		{"2h from today 16:00", at(time.March, 27, 16, 0), at(time.March, 27, 18, 0)},
+		{"2h from tomorrow 09:00", at(time.March, 28, 9, 0), at(time.March, 28, 11, 0)},
+		{"today 16:00-18:00", at(time.March, 27, 16, 0), at(time.March, 27, 18, 0)},
+		{"tomorrow 09:00-18:00", at(time.March, 28, 9, 0), at(time.March, 28, 18, 0)},
+		{"Monday 09:00-18:00", at(time.March, 30, 9, 0), at(time.March, 30, 18, 0)},
+		{"2026-04-01 09:00-18:00", at(time.April, 1, 9, 0), at(time.April, 1, 18, 0)},
+		{"fri 22:00-06:00", at(time.March, 27, 22, 0), at(time.March, 28, 6, 0)},
+		{"until 18:00", now, at(time.March, 27, 18, 0)},
+		{"until 09:00", now, at(time.March, 28, 9, 0)},
+		{"until tomorrow", now, at(time.March, 28, 0, 0)},
+		{"until friday", now, at(time.April, 3, 0, 0)},
+		{"until friday 18:00", now, at(time.March, 27, 18, 0)},
+		{"until friday 09:00", now, at(time.April, 3, 9, 0)},
+		// the DST change
+		{"sunday 09:00-18:00", at(time.March, 29, 9, 0), at(time.March, 29, 18, 0)},
+		{"saturday 22:00-06:00", at(time.March, 28, 22, 0), at(time.March, 29, 6, 0)},
+		{"until sunday 12:00", now, at(time.March, 29, 12, 0)},
+		{"2h from sunday 01:00", at(time.March, 29, 1, 0), at(time.March, 29, 4, 0)},
+		{"2026-10-25 01:00-04:00", at(time.October, 25, 1, 0), at(time.October, 25, 4, 0)},
+	}
+
+	for _, tt := range tests {
+		start, end, err := parseWindow(strings.Fields(tt.args), now)
+		if err != nil {
+			t.Errorf("%s: %s", tt.args, err)
+
+			continue
+		}
+
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: got %s - %s, want %s - %s", tt.args, start, end, tt.start, tt.end)
+		}
+	}
+
+	// the wall clock is kept on the DST days
+	if start, _, _ := parseWindow([]string{"sunday", "09:00-18:00"}, now); start.UTC().Hour() != 7 {
+		t.Errorf("sunday 09:00 is %s", start.UTC())
+	}
+
+	if _, end, _ := parseWindow([]string{"2026-10-25", "01:00-04:00"}, now); end.UTC().Hour() != 3 {
+		t.Errorf("sunday 04:00 is %s", end.UTC())
+	}
+
+	for _, args := range []string{"", "yesterday", "-2h", "2h to 14:00", "today 09:00-10:00", "25:00-26:00", "until", "until 2026-03-01"} {
+		if _, _, err := parseWindow(strings.Fields(args), now); err == nil {
+			t.Errorf("%#v: no error", args)
+		}
+	}
+}
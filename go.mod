@@ -3,17 +3,19 @@ module github.com/opsgin/opsgin
 go 1.19
 
 require (
+	github.com/gorilla/websocket v1.4.2
 	github.com/opsgenie/opsgenie-go-sdk-v2 v1.2.12
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/slack-go/slack v0.10.3
 	github.com/spf13/cobra v1.4.0
 	github.com/spf13/viper v1.11.0
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/exp v0.0.0-20230118134722-a68e582fa157
 )
 
 require (
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-retryablehttp v0.5.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect